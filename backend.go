@@ -0,0 +1,317 @@
+/* This file contains the storage backends that provide the files served by a Server */
+/* DirBackend serves a directory, FSBackend an io/fs.FS (such as embed.FS) and MemoryBackend an in-memory map */
+
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/* Backend provides the files read and written by clients. File names are passed as the client sent them */
+/* and the backend decides what they refer to. An *Error returned by a backend is sent to the client unchanged, */
+/* other errors are reported as described in errorCode */
+type Backend interface {
+
+	/* Open opens a file for a read request. size is the size of the file, or -1 if it is not known */
+	Open(name string) (r io.ReadCloser, size int64, err error)
+
+	/* Create starts a write request. The file must not change until the Upload is committed */
+	Create(name string) (Upload, error)
+}
+
+/* Upload receives the contents of a file written by a client */
+type Upload interface {
+	io.Writer
+
+	/* Commit is called once the whole file has been received, it makes the file available */
+	Commit() error
+
+	/* Abort is called if the transfer does not complete, the file is left as it was before the request */
+	Abort()
+}
+
+/* StatBackend may be implemented by a Backend that can tell the size of a file without opening it. */
+/* It is used for the tsize option when Open does not know the size */
+type StatBackend interface {
+	Stat(name string) (fs.FileInfo, error)
+}
+
+/* DirBackend returns a Backend that serves the files below root, the current directory if root is empty. */
+/* Absolute names, names with a ".." element, names that lead out of root through a symlink and the names */
+/* of staged uploads are refused with an Access violation error. Only regular files are served. Uploads are staged in a temporary file in the same directory */
+/* and renamed into place once they are complete, so a file is never seen half written */
+func DirBackend(root string) Backend {
+	if root == "" {
+		root = "."
+	}
+	return &dirBackend{root: root}
+}
+
+type dirBackend struct {
+	root string
+}
+
+func (d *dirBackend) Open(name string) (io.ReadCloser, int64, error) {
+	filePath, err := d.resolvePath(name)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	/* Only regular files are served. Directories would fail partway through the transfer and opening */
+	/* a named pipe could block, so both are refused before the file is opened */
+
+	if info, err := os.Stat(filePath); err != nil {
+		return nil, -1, err
+	} else if !info.Mode().IsRegular() {
+		return nil, -1, accessViolation()
+	}
+	fileRead, err := os.Open(filePath)
+	if err != nil {
+		return nil, -1, err
+	}
+	info, err := fileRead.Stat()
+	if err != nil {
+		fileRead.Close()
+		return nil, -1, err
+	}
+	if !info.Mode().IsRegular() {
+		fileRead.Close()
+		return nil, -1, accessViolation()
+	}
+	return fileRead, info.Size(), nil
+}
+
+func (d *dirBackend) Create(name string) (Upload, error) {
+	filePath, err := d.resolvePath(name)
+	if err != nil {
+		return nil, err
+	}
+	fileWrite, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &dirUpload{File: fileWrite, path: filePath}, nil
+}
+
+func (d *dirBackend) Stat(name string) (fs.FileInfo, error) {
+	filePath, err := d.resolvePath(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(filePath)
+}
+
+/* resolvePath returns the local path of the file a client asked for */
+func (d *dirBackend) resolvePath(fileName string) (string, error) {
+	if fileName == "" || strings.IndexByte(fileName, 0) >= 0 || path.IsAbs(fileName) || filepath.IsAbs(fileName) || filepath.VolumeName(fileName) != "" {
+		return "", accessViolation()
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(fileName), "/") {
+		if elem == ".." {
+			return "", accessViolation()
+		}
+	}
+	if isStagedUpload(fileName) {
+		return "", accessViolation()
+	}
+	root, err := filepath.Abs(d.root)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	fullPath := filepath.Join(root, filepath.FromSlash(fileName))
+
+	/* Symlinks below the root must not point out of it. The file does not exist yet on a write, */
+	/* so the longest part of the path that exists is checked */
+
+	existing := fullPath
+	for {
+		realPath, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			if !withinRoot(root, realPath) {
+				return "", accessViolation()
+			}
+			return fullPath, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return fullPath, nil
+		}
+		existing = parent
+	}
+}
+
+/* withinRoot reports whether realPath is root or a path below it. Both must be free of symlinks */
+func withinRoot(root string, realPath string) bool {
+	rel, err := filepath.Rel(root, realPath)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+/* isStagedUpload reports whether fileName has the form of a temporary upload file, "." name "." digits ".tmp". */
+/* Those are refused to every request, so no client can read a half written upload or write over one */
+func isStagedUpload(fileName string) bool {
+	base := filepath.Base(fileName)
+	if !strings.HasPrefix(base, ".") || !strings.HasSuffix(base, ".tmp") {
+		return false
+	}
+	name := strings.TrimSuffix(base[1:], ".tmp")
+	dot := strings.LastIndexByte(name, '.')
+	if dot <= 0 || dot == len(name)-1 {
+		return false
+	}
+	for _, c := range name[dot+1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func accessViolation() *Error {
+	return &Error{Code: CodeAccessViolation, Message: CodeAccessViolation.String()}
+}
+
+/* dirUpload is an upload staged in a temporary file next to path */
+type dirUpload struct {
+	*os.File
+	path string
+}
+
+/* Commit flushes the upload to disk and renames it to its path. */
+/* Temporary files are created with mode 0600, the upload is made readable like a file made by os.Create */
+func (u *dirUpload) Commit() error {
+	err := u.File.Chmod(0644)
+	if err == nil {
+		err = u.File.Sync()
+	}
+	if errClose := u.File.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(u.File.Name(), u.path)
+	}
+	if err != nil {
+		os.Remove(u.File.Name())
+	}
+	return err
+}
+
+/* Abort removes the temporary file */
+func (u *dirUpload) Abort() {
+	u.File.Close()
+	os.Remove(u.File.Name())
+}
+
+/* FSBackend returns a read only Backend that serves the files of fsys. */
+/* Names must be valid fs.FS paths, other names are refused with an Access violation error */
+func FSBackend(fsys fs.FS) Backend {
+	return &fsBackend{fsys: fsys}
+}
+
+type fsBackend struct {
+	fsys fs.FS
+}
+
+func (f *fsBackend) Open(name string) (io.ReadCloser, int64, error) {
+	if !fs.ValidPath(name) {
+		return nil, -1, accessViolation()
+	}
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, -1, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, -1, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, -1, accessViolation()
+	}
+	return file, info.Size(), nil
+}
+
+func (f *fsBackend) Create(name string) (Upload, error) {
+	return nil, fs.ErrPermission
+}
+
+func (f *fsBackend) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, accessViolation()
+	}
+	return fs.Stat(f.fsys, name)
+}
+
+/* MemoryBackend is a Backend that keeps files in memory, keyed by the name sent by the client. */
+/* The zero value is an empty backend ready to use */
+type MemoryBackend struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+/* NewMemoryBackend returns an empty MemoryBackend */
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{}
+}
+
+/* Store sets the contents of a file */
+func (m *MemoryBackend) Store(name string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files == nil {
+		m.files = make(map[string][]byte)
+	}
+	m.files[name] = data
+}
+
+/* Load returns the contents of a file and whether it exists */
+func (m *MemoryBackend) Load(name string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	return data, ok
+}
+
+func (m *MemoryBackend) Open(name string) (io.ReadCloser, int64, error) {
+	data, ok := m.Load(name)
+	if !ok {
+		return nil, -1, fs.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (m *MemoryBackend) Create(name string) (Upload, error) {
+	return &memoryUpload{backend: m, name: name}, nil
+}
+
+/* memoryUpload collects an upload and stores it in the backend when it is committed */
+type memoryUpload struct {
+	bytes.Buffer
+	backend *MemoryBackend
+	name    string
+}
+
+func (u *memoryUpload) Commit() error {
+	u.backend.Store(u.name, u.Buffer.Bytes())
+	return nil
+}
+
+func (u *memoryUpload) Abort() {}
@@ -0,0 +1,158 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+/* escapeRoot builds a served root next to a directory outside of it. The root holds a regular file, */
+/* a subdirectory, a symlink to the outside directory and a symlink to a file in it */
+func escapeRoot(t *testing.T) (root string, outside string) {
+	t.Helper()
+	base := t.TempDir()
+	root = filepath.Join(base, "root")
+	outside = filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "sub"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skipf("symlinks are not available: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "filelink")); err != nil {
+		t.Fatal(err)
+	}
+	return root, outside
+}
+
+var escapingNames = []string{
+	"../x",
+	"sub/../../x",
+	"/etc/passwd",
+	"link/secret",
+	"link/new",
+	"filelink",
+	".file.123.tmp",
+}
+
+func TestDirBackendRefusesEscapes(t *testing.T) {
+	root, outside := escapeRoot(t)
+	backend := DirBackend(root)
+	for _, name := range escapingNames {
+		var tftpErr *Error
+		if r, _, err := backend.Open(name); !errors.As(err, &tftpErr) || tftpErr.Code != CodeAccessViolation {
+			if err == nil {
+				r.Close()
+			}
+			t.Errorf("Open(%q) returned %v, want an Access violation", name, err)
+		}
+		if u, err := backend.Create(name); !errors.As(err, &tftpErr) || tftpErr.Code != CodeAccessViolation {
+			if err == nil {
+				u.Abort()
+			}
+			t.Errorf("Create(%q) returned %v, want an Access violation", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a file was created outside the root: %v", err)
+	}
+
+	r, size, err := backend.Open("file")
+	if err != nil || size != 4 {
+		t.Fatalf("Open of a file returned size %d, %v", size, err)
+	}
+	r.Close()
+	for _, name := range []string{"new", "sub/new", ".profile"} {
+		u, err := backend.Create(name)
+		if err != nil {
+			t.Errorf("Create(%q) returned %v", name, err)
+			continue
+		}
+		u.Abort()
+	}
+}
+
+func TestOpenRefusesDirectories(t *testing.T) {
+	root, _ := escapeRoot(t)
+	backends := map[string]Backend{
+		"DirBackend": DirBackend(root),
+		"FSBackend":  FSBackend(fstest.MapFS{"sub/file": {Data: []byte("data")}}),
+	}
+	for name, backend := range backends {
+		var tftpErr *Error
+		if _, _, err := backend.Open("sub"); !errors.As(err, &tftpErr) || tftpErr.Code != CodeAccessViolation {
+			t.Errorf("%s: Open of a directory returned %v", name, err)
+		}
+	}
+}
+
+/* TestEscapeOverTheWire checks that a client asking for a name outside the root gets ERROR 2 */
+/* for both reads and writes, and that nothing is written outside the root */
+func TestEscapeOverTheWire(t *testing.T) {
+	root, outside := escapeRoot(t)
+	addr := newTestServer(t, &Server{Root: root})
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, name := range escapingNames {
+		for _, opcode := range []string{"\x00\x01", "\x00\x02"} {
+			got, _ := exchange(t, conn, addr, []byte(opcode+name+"\x00octet\x00"))
+			if !bytes.HasPrefix(got, []byte("\x00\x05\x00\x02")) {
+				t.Errorf("request %q for %q answered with %q, want an Access violation error", opcode, name, got)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a file was created outside the root: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(outside, "secret")); err != nil || string(got) != "secret" {
+		t.Errorf("the file outside the root was changed: %q, %v", got, err)
+	}
+}
+
+func TestGetOfDirectory(t *testing.T) {
+	root, _ := escapeRoot(t)
+	addr := newTestServer(t, &Server{Root: root})
+	c := &Client{Addr: addr.String()}
+	err := c.Get("sub", filepath.Join(t.TempDir(), "sub"))
+	var tftpErr *Error
+	if !errors.As(err, &tftpErr) || tftpErr.Code != CodeAccessViolation {
+		t.Fatalf("Get of a directory returned %v", err)
+	}
+	if err := c.Get("file", filepath.Join(t.TempDir(), "file")); err != nil {
+		t.Fatalf("Get of a file returned %v", err)
+	}
+}
+
+func TestIsStagedUpload(t *testing.T) {
+	tests := map[string]bool{
+		".boot.img.123456.tmp":     true,
+		"sub/.boot.img.42.tmp":     true,
+		"boot.img":                 false,
+		".boot.tmp":                false,
+		".boot..tmp":               false,
+		".boot.12a.tmp":            false,
+		".profile":                 false,
+		"notes.1.tmp":              false,
+		".boot.img.123456.tmp.old": false,
+	}
+	for name, want := range tests {
+		if got := isStagedUpload(name); got != want {
+			t.Errorf("isStagedUpload(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -1,241 +1,322 @@
-package main
+package tftp
+
 import (
-    "os"
-    "fmt"
-    "net"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
-	"bytes"
 	"time"
 )
-func main() {
-
-    if len(os.Args) != 2 {
-		fmt.Println("Usage Example -> 'go run client.go tftpUtilities.go RequestType:InputFileName:OutputFileName' ")
-		os.Exit(1)
-	}
-	userInput := os.Args[1]
-	parameters := strings.Split(userInput, ":") 
-	requestType := parameters[0]
-	inputFileName := parameters[1]
-	outputFileName := parameters[2]
-	
-	/* Control Channel */	
-	
-    service := "127.0.0.1:1201"
-	udpAddr, err := net.ResolveUDPAddr("udp", service)
-    check(err)
-	controlChannel, err := net.DialUDP("udp", nil, udpAddr)
-    check(err)
-	if requestType == "read" {
-	    handleReadRequest(controlChannel, inputFileName, outputFileName)
-	} else {
-	    handleWriteRequest(controlChannel, inputFileName, outputFileName) 
+
+/* Client is a TFTP client for reading files from and writing files to a single server */
+type Client struct {
+	Addr    string            /* UDP address of the server, "127.0.0.1:1201" if empty. IPv6 addresses are written "[fe80::1%eth0]:69" */
+	Options map[string]string /* Options (RFC 2347) appended to every request */
+	Mode    string            /* Transfer mode, "octet" or "netascii". "octet" if empty */
+
+	/* Retransmission timeout, 5 seconds if zero. A non zero value is negotiated with the server (timeout, RFC 2349) */
+	Timeout time.Duration
+
+	/* If set, reads ask the server for the size of the file and writes announce it (tsize, RFC 2349) */
+	TransferSize bool
+
+	/* Called with the size reported by the server before a read transfers any data. Returning an error aborts the read */
+	OnTransferSize func(size int64) error
+
+	/* Retransmissions, backoff and overall deadline of a transfer. Requests are retransmitted by the same policy */
+	Retry RetryPolicy
+
+	/* Block number that follows block 65535, 0 or 1. If not zero it is negotiated with the server (rollover) */
+	Rollover uint16
+
+	Logger *log.Logger /* Progress messages are discarded if nil */
+}
+
+/* NewClient returns a Client for the server at addr */
+func NewClient(addr string) *Client {
+	return &Client{Addr: addr}
+}
+
+/* Get reads remoteFile from the server and stores it in localFile */
+func (c *Client) Get(remoteFile string, localFile string) error {
+	if err := checkRollover(c.Rollover); err != nil {
+		return err
+	}
+	conn, serverAddr, err := c.dial()
+	if err != nil {
+		return err
 	}
+	t, err := c.handleReadRequest(conn, serverAddr, remoteFile, localFile)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	/* The file is in place, so Get returns right away while the last Ack is guarded against loss in the background */
+
+	go func() {
+		t.dally()
+		conn.Close()
+	}()
+	return nil
 }
 
-/* Handler for read requests to the server */ 
-
-func handleReadRequest(controlChannel *net.UDPConn, inputFileName string, outputFileName string) {  
-
-	fmt.Println("Sending Read request.")
-    initialPacket := constructInitialPacket(1, inputFileName)
-	clientAddr:= controlChannel.LocalAddr()
-	clientAddrStr := clientAddr.String()
-	clientPort := strings.Split(clientAddrStr, ":")
-	fmt.Println("Client Port is : ", clientPort[1])
-    _, errInitialPk := controlChannel.Write(initialPacket)
-    check(errInitialPk)
-    controlChannel.Close()         
-	
-	/* Data Channel */
-	
-	var ingressBuf [516]byte
-    var ingressBufSize int
-    var serverAddr *net.UDPAddr
-    var clientDataBuf bytes.Buffer
-	var prevBlockNum uint16 = 0
-    var blockNum uint16 = 0
-	var lastPacket bool = false
-	
-	newService := "127.0.0.1:"+clientPort[1]
-	newudpAddr, err := net.ResolveUDPAddr("udp", newService)
-	check(err)
-	dataChannel, err := net.ListenUDP("udp", newudpAddr)
-	check(err) 
-    
-    /* Setting the read timeout limit for all data packets from the server to 8 seconds */	
-	dataChannel.SetReadDeadline(time.Now().Add(time.Second * 8))
-	
-	for {
-	        /* For the last data packet, wait for additional 8 seconds after it has been sent to the server. */
-            /* This handles the case when the last packet has been sent by client but not received by server. */
-            /* If the server resends the Ack for previous data packet, client sends the last data packet again */
-            /* File is created only after the entire content is read from the server */
-			
-		    if lastPacket == true {
-			   _, _, err := dataChannel.ReadFromUDP(ingressBuf[0:])
-			   if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				   fileWrite, err := os.Create(outputFileName)
-	               check(err)
-		           _, errOutput := fileWrite.WriteString(clientDataBuf.String())
-	               check(errOutput)
-		           fileWrite.Close()
-				   fmt.Println("File has been fully read from the server into the current directory.")
-				   break
-			   }
-			} else {
-	               ingressBufferSize, remoteAddr, err := dataChannel.ReadFromUDP(ingressBuf[0:])
-				   if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-			           fmt.Println("Server timed out. Closing connection. Try again.")
-				       break
-			       }
-				   ingressBufSize = ingressBufferSize
-				   serverAddr = remoteAddr
-			}
-			ingressByte := convertDataIngressBufType(ingressBuf)
-			opcode := getOpcode(ingressByte)
-			/* Received Error Packet from the server */
-			if opcode == 5 {
-			   fmt.Println("Data transfer did not succeed. Closing connection. Try again.")
-			   break
-			}
-			blockNum = getBlockNum(ingressByte)
-			fmt.Println("Received Data Block ", blockNum)
-			
-			/* Storing only unique data blocks in the buffer */ 
-			/* If Data is received and stored but if Ack did not reach the server, */
-			/* data will be resent from server. In this case, no need to store it in the buffer again. */
-			
-			if prevBlockNum < blockNum {                    
-                ingressDataBuf := getIngressData(ingressByte, ingressBufSize)
-                clientDataBuf.Grow(len(ingressDataBuf)) 			
-	            _, err := clientDataBuf.Write(ingressDataBuf)
-	            check(err)
+/* Put writes localFile to the server as remoteFile */
+func (c *Client) Put(localFile string, remoteFile string) error {
+	if err := checkRollover(c.Rollover); err != nil {
+		return err
+	}
+	conn, serverAddr, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return c.handleWriteRequest(conn, serverAddr, localFile, remoteFile)
+}
+
+/* dial opens the socket used for a whole transfer. Its port is the client's transfer ID (RFC 1350): */
+/* the request is sent from it and every packet of the transfer is sent and received on it */
+func (c *Client) dial() (*net.UDPConn, *net.UDPAddr, error) {
+	service := c.Addr
+	if service == "" {
+		service = "127.0.0.1:1201"
+	}
+	serverAddr, err := net.ResolveUDPAddr("udp", service)
+	if err != nil {
+		return nil, nil, err
+	}
+	network := "udp6"
+	if serverAddr.IP.To4() != nil {
+		network = "udp4"
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, serverAddr, nil
+}
+
+/* requestOptions returns the options to append to a request, keyed by lower case name. */
+/* size is the size of the file being written, it is ignored for reads */
+func (c *Client) requestOptions(read bool, size int64) map[string]string {
+	options := make(map[string]string, len(c.Options)+2)
+	for name, value := range c.Options {
+		options[strings.ToLower(name)] = value
+	}
+	if c.Timeout > 0 {
+		options["timeout"] = timeoutOption(c.Timeout)
+	}
+	if c.Rollover != 0 {
+		options["rollover"] = strconv.Itoa(int(c.Rollover))
+	}
+	if c.TransferSize {
+		if read {
+			options["tsize"] = "0"
+		} else if size >= 0 {
+			options["tsize"] = strconv.FormatInt(size, 10)
+		}
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	return options
+}
+
+/* newTransferOptions returns the values used for a transfer until the server acknowledges options */
+func (c *Client) newTransferOptions(read bool) *transferOptions {
+	opts := newTransferOptions(read)
+	if c.Timeout > 0 {
+		opts.timeout = c.Timeout
+	}
+	opts.rollover = c.Rollover
+	opts.retry = c.Retry
+	return opts
+}
+
+/* mode returns the transfer mode of the requests */
+func (c *Client) mode() (string, error) {
+	if c.Mode == "" {
+		return modeOctet, nil
+	}
+	mode, err := parseMode(c.Mode)
+	if err == nil && mode == modeMail {
+		err = errors.New("tftp: mail mode is not supported")
+	}
+	return mode, err
+}
+
+func (c *Client) logf(format string, v ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Printf(format, v...)
+	}
+}
+
+/* Handler for read requests to the server */
+
+func (c *Client) handleReadRequest(conn *net.UDPConn, serverAddr *net.UDPAddr, inputFileName string, outputFileName string) (*transfer, error) {
+
+	c.logf("Sending Read request.")
+	mode, err := c.mode()
+	if err != nil {
+		return nil, err
+	}
+	c.logf("Client Port is : %d", conn.LocalAddr().(*net.UDPAddr).Port)
+	options := c.requestOptions(true, -1)
+	opts := c.newTransferOptions(true)
+
+	/* The server answers from a new port with an OACK if it accepted any of the requested options, */
+	/* or with the first data block. The rest of the transfer is with that port */
+	/* The request is retransmitted if neither reaches the client within the timeout period */
+
+	t := newClientTransfer(conn, serverAddr, opts, c.logf)
+	ingress, err := t.request(&ReadRequest{Filename: inputFileName, Mode: mode, Options: options}, func(p packet) bool {
+		switch p.(type) {
+		case *OptionAck, *Data:
+			return true
+		}
+		return false
+	})
+	if err == ErrTimeout {
+		c.logf("Server timed out. Closing connection. Try again.")
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	var first *Data
+	switch p := ingress.(type) {
+	case *OptionAck:
+		err := acceptOptions(options, p, opts)
+		if err != nil {
+			return nil, t.abort(err)
+		}
+		if opts.transferSize >= 0 && c.OnTransferSize != nil {
+			err := c.OnTransferSize(opts.transferSize)
+			if err != nil {
+				return nil, t.abort(err)
 			}
-			
-			/* If Ack from client did not reach the server, server will timeout and send prev data packet again. */
-            /* So send the Ack for the prev data block again to ensure that server will move onto the next data packet */
-			
-			prevBlockNum = blockNum
-			ackBuf := constructAckPacket(4, prevBlockNum)
-			_, errWr1 := dataChannel.WriteToUDP(ackBuf, serverAddr)
-            check(errWr1)
-			fmt.Println("Sent Ack for block: ", prevBlockNum)
-			if ingressBufSize < 516 {
-			    lastPacket = true
-			}	
 		}
-		dataChannel.Close()
-        os.Exit(0)
+		errWr := t.send(&Ack{Block: 0})
+		if errWr != nil {
+			return nil, errWr
+		}
+		c.logf("Sent Ack for option acknowledgment.")
+	case *Data:
+		first = p
+	}
+
+	/* File is staged only once the server has answered. Blocks are written to it as they arrive, */
+	/* so only the current block is held in memory. The staged file is renamed over the local file once */
+	/* the read completes, so a read that does not complete leaves an existing file untouched and no partial file behind */
+
+	fileWrite, err := os.CreateTemp(filepath.Dir(outputFileName), "."+filepath.Base(outputFileName)+".*.tmp")
+	if err != nil {
+		return nil, t.abort(err)
+	}
+	var w io.Writer = fileWrite
+	var netascii *netasciiWriter
+	if mode == modeNetascii {
+		netascii = newNetasciiWriter(w)
+		w = netascii
+	}
+	err = t.receiveData(w, first)
+	if err == nil && netascii != nil {
+		err = netascii.Close()
+	}
+	if err != nil {
+		c.logf("Data transfer did not succeed. Closing connection. Try again.")
+		fileWrite.Close()
+		os.Remove(fileWrite.Name())
+		return nil, err
+	}
+	err = fileWrite.Chmod(0644)
+	if errClose := fileWrite.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(fileWrite.Name(), outputFileName)
+	}
+	if err != nil {
+		os.Remove(fileWrite.Name())
+		return nil, err
+	}
+	c.logf("File has been fully read from the server into the current directory.")
+	return t, nil
 }
 
 /* Handler for write requests to the server */
 
-func handleWriteRequest(controlChannel *net.UDPConn, inputFileName string, outputFileName string) {  
-
-    fmt.Println("Sending write request.")
-    initialPacket := constructInitialPacket(2, outputFileName)
-	clientAddr:= controlChannel.LocalAddr()
-	clientAddrStr := clientAddr.String()
-	clientPort := strings.Split(clientAddrStr, ":")
-	fmt.Println("Client Port is : ", clientPort[1])
-    _, errWrite := controlChannel.Write(initialPacket)
-    check(errWrite)
-    controlChannel.Close()
-	
-	/* Data Channel */
-	
-	var ingressBuf [4]byte
-	prevDataPacket := make([]byte, 512)
-	var serverAddr *net.UDPAddr
-	var expectedBlockNum uint16 = 0
-	var lastPacket bool = false
-	var firstAck bool = true
-	var retryCount int = 1
-	var closeConn bool = false
-	
-	newService := "127.0.0.1:"+clientPort[1]
-	newudpAddr, err := net.ResolveUDPAddr("udp", newService)
-	check(err)
-	dataChannel, err := net.ListenUDP("udp", newudpAddr)
-	check(err) 
-	fileRead, err := os.Open(inputFileName) 
-    check(err)
-	
-	/* Read timeout for Ack from the server is set to 4 seconds */
-	dataChannel.SetReadDeadline(time.Now().Add(time.Second * 4))
-    
+func (c *Client) handleWriteRequest(conn *net.UDPConn, serverAddr *net.UDPAddr, inputFileName string, outputFileName string) error {
+
+	c.logf("Sending write request.")
+	mode, err := c.mode()
+	if err != nil {
+		return err
+	}
+	fileRead, err := os.Open(inputFileName)
+	if err != nil {
+		return err
+	}
+	defer fileRead.Close()
+	c.logf("Client Port is : %d", conn.LocalAddr().(*net.UDPAddr).Port)
+
+	/* The size of a netascii transfer is not known until the file is translated, so tsize is only sent in octet mode */
+
+	var r io.Reader = fileRead
+	var fileSize int64 = -1
+	if mode == modeNetascii {
+		r = newNetasciiReader(fileRead)
+	} else if info, err := fileRead.Stat(); err == nil && info.Mode().IsRegular() {
+		fileSize = info.Size()
+	}
+	options := c.requestOptions(false, fileSize)
+	opts := c.newTransferOptions(false)
+
 	/* The first Ack from the server is for block 0. It is to start the data transfer from the client. */
-	/* If first Ack did not reach the client within the timeout period, datachannel client connection is closed */
-	/* For other Acks, the previous data packet is retransmitted upto 4 times after the timeouts before closing the connection. */
-	
-	for {
-	    for { 
-	        _, remoteAddr, err := dataChannel.ReadFromUDP(ingressBuf[0:])
-		    if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-			    if firstAck == false {
-				    if retryCount == 4 {
-					   closeConn = true
-					   break
-					}
-					_, errWr := dataChannel.WriteToUDP(prevDataPacket, remoteAddr)
-                    check(errWr)
-					retryCount += 1
-				} else {
-				    fmt.Println("Server timed out. Closing connection. Try again.") 
-					closeConn = true
-					break
-				}
-			} else {
-                serverAddr = remoteAddr			   
-			    break
-			}
-		}
-		if closeConn == true {
-		    break
+	/* If the server accepted any of the requested options, it answers with an OACK in place of Ack 0 */
+	/* The server answers from a new port and the rest of the transfer is with that port */
+	/* If neither reaches the client within the timeout period, the request is retransmitted */
+
+	t := newClientTransfer(conn, serverAddr, opts, c.logf)
+	ingress, err := t.request(&WriteRequest{Filename: outputFileName, Mode: mode, Options: options}, func(p packet) bool {
+		switch p.(type) {
+		case *OptionAck, *Ack:
+			return true
 		}
-		ingressByte := convertAckIngressBufType(ingressBuf)
-		opcode := getOpcode(ingressByte)
-		if opcode != 4 {
-		   fmt.Println("Data transfer did not succeed. Closing connection. Try again.")
-		   break
+		return false
+	})
+	if err == ErrTimeout {
+		c.logf("Server timed out. Closing connection. Try again.")
+		return err
+	} else if err != nil {
+		return err
+	}
+	switch p := ingress.(type) {
+	case *OptionAck:
+		err := acceptOptions(options, p, opts)
+		if err != nil {
+			return t.abort(err)
 		}
-		blockNum := getBlockNum(ingressByte)
-		fmt.Println("Received Ack for block: ", blockNum)
-		firstAck = false
-		
-		/* When the Ack for last packet is received, client successfully closes the connection */
-		if blockNum == expectedBlockNum {
-		   if lastPacket == true {
-		      fmt.Println("File has been successfully written to the server.")
-		      break
-		   }
-		   inputBuf := make([]byte, 512)
-           inputBufSize, err := fileRead.Read(inputBuf)
-		   /* If there is a file read failure send error packet to server */
-		   if err != nil {
-		       errorPacket := constructErrorPacket(5)
-			   _, errToServer := dataChannel.WriteToUDP(errorPacket, serverAddr)
-               check(errToServer)
-			   break
-		   }
-		   expectedBlockNum = expectedBlockNum+1
-		   dataPacket := constructDataPacket(expectedBlockNum, inputBuf, inputBufSize)
-		   _, errWrite := dataChannel.WriteToUDP(dataPacket, serverAddr)
-           check(errWrite)
-		   if len(dataPacket) < 516 {
-		      lastPacket = true
-		   }
-		   fmt.Println("Sent data block ", expectedBlockNum)
-		   prevDataPacket = make([]byte, len(dataPacket))
-		   prevDataPacket = dataPacket
-		} else {
-		   fmt.Println("Data transfer did not succeed. Closing connection. Try again.")
-		   break
+		c.logf("Received option acknowledgment.")
+	case *Ack:
+		c.logf("Received Ack for block: %d", p.Block)
+		if p.Block != 0 {
+			c.logf("Data transfer did not succeed. Closing connection. Try again.")
+			return t.abort(&Error{Code: CodeIllegalOperation, Message: fmt.Sprintf("unexpected Ack for block %d", p.Block)})
 		}
 	}
-	fileRead.Close()
-	dataChannel.Close()
-    os.Exit(0)
-}
 
+	/* When the Ack for last packet is received, client successfully closes the connection */
+
+	err = t.sendData(r, nil)
+	if err != nil {
+		c.logf("Data transfer did not succeed. Closing connection. Try again.")
+		return err
+	}
+	c.logf("File has been successfully written to the server.")
+	return nil
+}
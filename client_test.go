@@ -0,0 +1,151 @@
+package tftp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* failingServer answers one read request with a first DATA block and then fails the transfer with an ERROR packet */
+func failingServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		_, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		conn.WriteToUDP(append([]byte("\x00\x03\x00\x01"), make([]byte, 512)...), client)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadFromUDP(buf); err != nil {
+			return
+		}
+		conn.WriteToUDP([]byte("\x00\x05\x00\x00backend failed\x00"), client)
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestGetKeepsLocalFileOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "local")
+	if err := os.WriteFile(local, []byte("old contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{Addr: failingServer(t).String(), Timeout: time.Second}
+	if err := c.Get("broken", local); err == nil {
+		t.Fatal("Get of a failing file succeeded")
+	}
+	if b, err := os.ReadFile(local); err != nil || string(b) != "old contents" {
+		t.Fatalf("local file is %q, %v after a failed Get", b, err)
+	}
+
+	served := chdirTemp(t)
+	if err := os.WriteFile(filepath.Join(served, "good"), []byte("new contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.Addr = newTestServer(t, &Server{}).String()
+	if err := c.Get("good", local); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(local); err != nil || string(b) != "new contents" {
+		t.Fatalf("local file is %q, %v after Get", b, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("%d files left in the directory", len(entries))
+	}
+}
+
+/* TestGetReturnsBeforeDally checks that Get does not keep the caller waiting while it guards the last Ack */
+func TestGetReturnsBeforeDally(t *testing.T) {
+	dir := chdirTemp(t)
+	if err := os.WriteFile(filepath.Join(dir, "boot"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := newTestServer(t, &Server{})
+	c := &Client{Addr: addr.String(), Timeout: 3 * time.Second}
+	start := time.Now()
+	if err := c.Get("boot", filepath.Join(dir, "copy")); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Get took %v", elapsed)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "copy")); err != nil || string(b) != "hello" {
+		t.Fatalf("local file is %q, %v after Get", b, err)
+	}
+}
+
+/* TestClientLocksOntoServerPort checks that the client keeps to the port the server first answered from, */
+/* and answers a DATA block from any other port with Unknown transfer ID */
+func TestClientLocksOntoServerPort(t *testing.T) {
+	control, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	data, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	foreign, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer foreign.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		control.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, client, err := control.ReadFromUDP(buf)
+		if err != nil {
+			served <- err
+			return
+		}
+		steps := []struct {
+			from *net.UDPConn
+			send string
+			want string
+		}{
+			{data, "\x00\x03\x00\x01" + strings.Repeat("a", 512), "\x00\x04\x00\x01"},
+			{foreign, "\x00\x03\x00\x02bad", "\x00\x05\x00\x05"},
+			{data, "\x00\x03\x00\x02good", "\x00\x04\x00\x02"},
+		}
+		for _, step := range steps {
+			step.from.WriteToUDP([]byte(step.send), client)
+			step.from.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := step.from.ReadFromUDP(buf)
+			if err != nil {
+				served <- err
+				return
+			}
+			if !strings.HasPrefix(string(buf[:n]), step.want) {
+				served <- fmt.Errorf("%q answered with %q, want %q", step.send[:4], buf[:n], step.want)
+				return
+			}
+		}
+		served <- nil
+	}()
+
+	local := filepath.Join(t.TempDir(), "file")
+	c := &Client{Addr: control.LocalAddr().String()}
+	if err := c.Get("file", local); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(local); err != nil || string(got) != strings.Repeat("a", 512)+"good" {
+		t.Fatalf("stored %q, %v", got, err)
+	}
+}
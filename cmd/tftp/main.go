@@ -0,0 +1,83 @@
+/* tftp reads files from or writes files to a TFTP server */
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	tftp "github.com/jaykeerth/FileTransferAPIs-Golang"
+)
+
+func main() {
+
+	usage := "Usage Example -> 'tftp [-server host:port] [-blksize n] [-timeout s] [-tsize] [-windowsize n] [-rollover n] [-retries n] [-backoff f] [-deadline s] [-adaptive] [-mode netascii|octet] RequestType:InputFileName:OutputFileName' where RequestType is read or write"
+	serverAddr := flag.String("server", "127.0.0.1:1201", "UDP address of the server, IPv6 addresses in brackets such as [::1]:69")
+	blockSize := flag.Int("blksize", 0, "block size to negotiate with the server (8 to 65464), 512 if not set")
+	timeout := flag.Int("timeout", 0, "retransmission timeout in seconds to negotiate with the server (1 to 255), 5 if not set")
+	windowSize := flag.Int("windowsize", 0, "number of blocks to send before waiting for an Ack (1 to 65535), 1 if not set")
+	rollover := flag.Int("rollover", 0, "block number that follows block 65535 (0 or 1), 0 if not set")
+	retries := flag.Int("retries", 0, "retransmissions of a packet before giving up, 3 if not set and none if negative")
+	backoff := flag.Float64("backoff", 0, "factor the timeout grows by after each retransmission, no backoff if not set")
+	adaptive := flag.Bool("adaptive", false, "adapt the timeout to the measured round trip time, upto -timeout")
+	deadline := flag.Int("deadline", 0, "longest a transfer may take in seconds, no limit if not set")
+	mode := flag.String("mode", "octet", "transfer mode, netascii translates line endings")
+	transferSize := flag.Bool("tsize", false, "ask the server for the file size on read and announce it on write")
+	flag.Usage = func() {
+		fmt.Println(usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || (*rollover != 0 && *rollover != 1) {
+		flag.Usage()
+		os.Exit(1)
+	}
+	userInput := flag.Arg(0)
+	parameters := strings.Split(userInput, ":")
+	if len(parameters) != 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	requestType := parameters[0]
+	inputFileName := parameters[1]
+	outputFileName := parameters[2]
+
+	client := tftp.NewClient(*serverAddr)
+	client.Logger = log.New(os.Stdout, "", 0)
+	client.Mode = *mode
+	client.Options = map[string]string{}
+	if *blockSize != 0 {
+		client.Options["blksize"] = strconv.Itoa(*blockSize)
+	}
+	if *windowSize != 0 {
+		client.Options["windowsize"] = strconv.Itoa(*windowSize)
+	}
+	client.Timeout = time.Duration(*timeout) * time.Second
+	client.TransferSize = *transferSize
+	client.Rollover = uint16(*rollover)
+	client.Retry = tftp.RetryPolicy{
+		Retries:  *retries,
+		Backoff:  *backoff,
+		Jitter:   0.1,
+		Deadline: time.Duration(*deadline) * time.Second,
+		Adaptive: *adaptive,
+	}
+	client.OnTransferSize = func(size int64) error {
+		fmt.Println("File size is", size, "bytes")
+		return nil
+	}
+	var err error
+	if requestType == "read" {
+		err = client.Get(inputFileName, outputFileName)
+	} else {
+		err = client.Put(inputFileName, outputFileName)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error occurred: ", err.Error())
+		os.Exit(1)
+	}
+}
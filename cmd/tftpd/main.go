@@ -0,0 +1,49 @@
+/* tftpd serves files from a directory over TFTP, the current directory unless -root is given */
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	tftp "github.com/jaykeerth/FileTransferAPIs-Golang"
+)
+
+func main() {
+
+	addr := flag.String("addr", "127.0.0.1:1201", "UDP address to listen on, \":69\" for all addresses on the standard port")
+	iface := flag.String("interface", "", "network interface to listen on, with the port of -addr")
+	root := flag.String("root", ".", "directory to serve, clients cannot reach files outside of it")
+	retries := flag.Int("retries", 0, "retransmissions of a packet before giving up on a transfer, 3 if not set and none if negative")
+	backoff := flag.Float64("backoff", 0, "factor the timeout grows by after each retransmission, no backoff if not set")
+	adaptive := flag.Bool("adaptive", false, "adapt the timeout to the measured round trip time, upto 5 seconds")
+	deadline := flag.Int("deadline", 0, "longest a transfer may take in seconds, no limit if not set")
+	flag.Parse()
+	server := tftp.NewServer(*addr)
+	server.Interface = *iface
+	server.Root = *root
+	server.Retry = tftp.RetryPolicy{
+		Retries:  *retries,
+		Backoff:  *backoff,
+		Jitter:   0.1,
+		Deadline: time.Duration(*deadline) * time.Second,
+		Adaptive: *adaptive,
+	}
+	server.Logger = log.New(os.Stdout, "", log.LstdFlags)
+
+	/* On interrupt the server is closed, so that uploads in progress are discarded before exiting */
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Close()
+	}()
+	err := server.ListenAndServe()
+	if err != nil && err != tftp.ErrServerClosed {
+		log.New(os.Stderr, "", 0).Fatalln("Error occurred: ", err.Error())
+	}
+}
@@ -0,0 +1,3 @@
+/* Package tftp implements a TFTP (RFC 1350) server and client. */
+/* The tftpd and tftp commands in the cmd directory are built on top of it. */
+package tftp
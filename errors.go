@@ -0,0 +1,112 @@
+/* This file contains the TFTP error codes (RFC 1350, RFC 2347) and their mapping to Go errors */
+
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+)
+
+/* ErrorCode is the error number carried in an ERROR packet */
+type ErrorCode uint16
+
+const (
+	CodeNotDefined        ErrorCode = 0 /* Not defined, see error message */
+	CodeFileNotFound      ErrorCode = 1 /* File not found */
+	CodeAccessViolation   ErrorCode = 2 /* Access violation */
+	CodeDiskFull          ErrorCode = 3 /* Disk full or allocation exceeded */
+	CodeIllegalOperation  ErrorCode = 4 /* Illegal TFTP operation */
+	CodeUnknownTID        ErrorCode = 5 /* Unknown transfer ID */
+	CodeFileExists        ErrorCode = 6 /* File already exists */
+	CodeNoSuchUser        ErrorCode = 7 /* No such user */
+	CodeOptionNegotiation ErrorCode = 8 /* Option negotiation failed (RFC 2347) */
+)
+
+var errorCodeText = map[ErrorCode]string{
+	CodeNotDefined:        "Not defined",
+	CodeFileNotFound:      "File not found",
+	CodeAccessViolation:   "Access violation",
+	CodeDiskFull:          "Disk full or allocation exceeded",
+	CodeIllegalOperation:  "Illegal TFTP operation",
+	CodeUnknownTID:        "Unknown transfer ID",
+	CodeFileExists:        "File already exists",
+	CodeNoSuchUser:        "No such user",
+	CodeOptionNegotiation: "Option negotiation failed",
+}
+
+func (c ErrorCode) String() string {
+	if text, ok := errorCodeText[c]; ok {
+		return text
+	}
+	return fmt.Sprintf("Error code %d", uint16(c))
+}
+
+/* Error is a TFTP error. Errors received from the peer in an ERROR packet are returned as *Error */
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" || e.Message == e.Code.String() {
+		return "tftp: " + e.Code.String()
+	}
+	return fmt.Sprintf("tftp: %s: %s", e.Code, e.Message)
+}
+
+/* errorCode picks the error code that describes err to the peer */
+func errorCode(err error) ErrorCode {
+	var tftpErr *Error
+	switch {
+	case errors.As(err, &tftpErr):
+		return tftpErr.Code
+	case errors.Is(err, fs.ErrNotExist):
+		return CodeFileNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return CodeAccessViolation
+	case errors.Is(err, fs.ErrExist):
+		return CodeFileExists
+	case errors.Is(err, syscall.ENOSPC):
+		return CodeDiskFull
+	}
+	return CodeNotDefined
+}
+
+/* errorPacket builds the ERROR packet that reports err to the peer */
+/* File system and other operating system errors are reported by their code only, so local paths are not leaked. */
+/* Their full text is only for the local log. Errors of this package, such as ErrTimeout or ErrDeadline, */
+/* are sent without their "tftp: " prefix, like the messages of illegalOperation */
+func errorPacket(err error) *ErrorPacket {
+	var tftpErr *Error
+	if errors.As(err, &tftpErr) {
+		return &ErrorPacket{Code: tftpErr.Code, Message: tftpErr.Message}
+	}
+	code := errorCode(err)
+	if code == CodeNotDefined && !isSystemError(err) {
+		return &ErrorPacket{Code: code, Message: strings.TrimPrefix(err.Error(), "tftp: ")}
+	}
+	return &ErrorPacket{Code: code, Message: code.String()}
+}
+
+/* isSystemError reports whether err comes from the operating system, whose messages name local files */
+func isSystemError(err error) bool {
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	var syscallErr *os.SyscallError
+	var errno syscall.Errno
+	return errors.As(err, &pathErr) || errors.As(err, &linkErr) || errors.As(err, &syscallErr) || errors.As(err, &errno)
+}
+
+/* remoteError converts an ERROR packet received from the peer into an *Error */
+func remoteError(p *ErrorPacket) *Error {
+	return &Error{Code: p.Code, Message: p.Message}
+}
+
+/* illegalOperation builds the ERROR packet sent in reply to a packet that cannot be decoded or is not allowed */
+func illegalOperation(err error) *ErrorPacket {
+	return &ErrorPacket{Code: CodeIllegalOperation, Message: strings.TrimPrefix(err.Error(), "tftp: ")}
+}
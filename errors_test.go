@@ -0,0 +1,31 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestErrorPacket(t *testing.T) {
+	tests := []struct {
+		err  error
+		want ErrorPacket
+	}{
+		{&Error{Code: CodeAccessViolation, Message: "read only"}, ErrorPacket{Code: CodeAccessViolation, Message: "read only"}},
+		{&fs.PathError{Op: "open", Path: "/srv/tftp/a", Err: fs.ErrNotExist}, ErrorPacket{Code: CodeFileNotFound, Message: "File not found"}},
+		{&fs.PathError{Op: "read", Path: "/srv/tftp/sub", Err: syscall.EISDIR}, ErrorPacket{Code: CodeNotDefined, Message: "Not defined"}},
+		{&os.LinkError{Op: "rename", Old: "/srv/tftp/.a.tmp", New: "/srv/tftp/a", Err: syscall.EXDEV}, ErrorPacket{Code: CodeNotDefined, Message: "Not defined"}},
+		{fmt.Errorf("writing: %w", syscall.EIO), ErrorPacket{Code: CodeNotDefined, Message: "Not defined"}},
+		{errors.New("no boot menu for this host"), ErrorPacket{Code: CodeNotDefined, Message: "no boot menu for this host"}},
+		{ErrTimeout, ErrorPacket{Code: CodeNotDefined, Message: "peer timed out"}},
+		{ErrDeadline, ErrorPacket{Code: CodeNotDefined, Message: "transfer deadline exceeded"}},
+	}
+	for _, test := range tests {
+		if got := errorPacket(test.err); *got != test.want {
+			t.Errorf("errorPacket(%v) = %+v, want %+v", test.err, *got, test.want)
+		}
+	}
+}
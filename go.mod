@@ -0,0 +1,3 @@
+module github.com/jaykeerth/FileTransferAPIs-Golang
+
+go 1.21
@@ -0,0 +1,118 @@
+/* This file contains the handlers that serve read and write requests. Applications set Server.ReadHandler */
+/* and Server.WriteHandler to produce or consume file contents themselves, much like net/http's Handler */
+
+package tftp
+
+import (
+	"io"
+	"io/fs"
+	"net"
+)
+
+/* Request describes a read or write request to a handler */
+type Request struct {
+	Filename string            /* File name sent by the client */
+	Addr     *net.UDPAddr      /* Address of the client */
+	Mode     string            /* "octet" or "netascii". The server translates netascii, handlers deal with the file contents only */
+	Options  map[string]string /* Options requested by the client (RFC 2347), keyed by lower case name */
+
+	/* Options the server accepted and acknowledged in its OACK, empty if none. Options are negotiated before */
+	/* the handler is called, except tsize on a read request: its answer depends on the file ServeRead returns, */
+	/* so it is negotiated afterwards and never shows up here for reads */
+	Negotiated map[string]string
+}
+
+/* ReadHandler serves read requests. ServeRead returns the contents of the requested file. */
+/* If the reader has a Size() int64 or Stat() (fs.FileInfo, error) method, it is used to answer the tsize option. */
+/* If it is an io.Closer it is closed when the transfer ends. */
+/* A returned error is reported to the client, an *Error with its own code and message */
+type ReadHandler interface {
+	ServeRead(r *Request) (io.Reader, error)
+}
+
+/* ReadHandlerFunc adapts a function to a ReadHandler */
+type ReadHandlerFunc func(r *Request) (io.Reader, error)
+
+func (f ReadHandlerFunc) ServeRead(r *Request) (io.Reader, error) {
+	return f(r)
+}
+
+/* WriteHandler serves write requests. ServeWrite returns the writer that receives the contents of the file. */
+/* If the writer implements Upload, Commit is called once the whole file has been received and Abort if the transfer */
+/* does not complete. Otherwise, if it is an io.Closer it is closed when the transfer ends. */
+/* A returned error is reported to the client, an *Error with its own code and message */
+type WriteHandler interface {
+	ServeWrite(r *Request) (io.Writer, error)
+}
+
+/* WriteHandlerFunc adapts a function to a WriteHandler */
+type WriteHandlerFunc func(r *Request) (io.Writer, error)
+
+func (f WriteHandlerFunc) ServeWrite(r *Request) (io.Writer, error) {
+	return f(r)
+}
+
+/* backendHandler serves requests from the files of a Backend */
+type backendHandler struct {
+	backend Backend
+}
+
+func (b backendHandler) ServeRead(r *Request) (io.Reader, error) {
+	fileRead, size, err := b.backend.Open(r.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if stat, ok := b.backend.(StatBackend); ok && size < 0 {
+		if info, err := stat.Stat(r.Filename); err == nil && info.Mode().IsRegular() {
+			size = info.Size()
+		}
+	}
+	return &sizedReader{ReadCloser: fileRead, size: size}, nil
+}
+
+func (b backendHandler) ServeWrite(r *Request) (io.Writer, error) {
+	return b.backend.Create(r.Filename)
+}
+
+/* sizedReader is a file opened by a Backend together with its size, -1 if not known */
+type sizedReader struct {
+	io.ReadCloser
+	size int64
+}
+
+func (r *sizedReader) Size() int64 {
+	return r.size
+}
+
+/* readerSize returns the number of bytes r holds, or -1 if it cannot tell */
+func readerSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Size() int64 }:
+		return v.Size()
+	case interface {
+		Stat() (fs.FileInfo, error)
+	}:
+		if info, err := v.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size()
+		}
+	}
+	return -1
+}
+
+/* finishWrite ends a write request on w. err is the outcome of the transfer and the error returned */
+/* is the final outcome, once the upload has been committed or aborted */
+func finishWrite(w io.Writer, err error) error {
+	if upload, ok := w.(Upload); ok {
+		if err != nil {
+			upload.Abort()
+			return err
+		}
+		return upload.Commit()
+	}
+	if closer, ok := w.(io.Closer); ok {
+		if errClose := closer.Close(); err == nil {
+			err = errClose
+		}
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type uploadBuffer struct {
+	bytes.Buffer
+}
+
+func (u *uploadBuffer) Close() error { return nil }
+
+func TestHandlersSeeOptions(t *testing.T) {
+	readReqs := make(chan *Request, 1)
+	writeReqs := make(chan *Request, 1)
+	addr := newTestServer(t, &Server{
+		ReadHandler: ReadHandlerFunc(func(r *Request) (io.Reader, error) {
+			readReqs <- r
+			return strings.NewReader("contents"), nil
+		}),
+		WriteHandler: WriteHandlerFunc(func(r *Request) (io.Writer, error) {
+			writeReqs <- r
+			return &uploadBuffer{}, nil
+		}),
+	})
+	dir := t.TempDir()
+	var size int64 = -1
+	c := &Client{
+		Addr:           addr.String(),
+		Timeout:        time.Second,
+		TransferSize:   true,
+		OnTransferSize: func(n int64) error { size = n; return nil },
+		Options:        map[string]string{"blksize": "1024", "x-unknown": "1"},
+	}
+	if err := c.Get("a", filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	readReq := <-readReqs
+	if readReq.Options["blksize"] != "1024" || readReq.Options["x-unknown"] != "1" || readReq.Options["tsize"] != "0" {
+		t.Errorf("read handler got options %v", readReq.Options)
+	}
+	if len(readReq.Negotiated) != 2 || readReq.Negotiated["blksize"] != "1024" || readReq.Negotiated["timeout"] != "1" {
+		t.Errorf("read handler got negotiated options %v", readReq.Negotiated)
+	}
+	if size != int64(len("contents")) {
+		t.Errorf("client was told a size of %d, want %d", size, len("contents"))
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "b"), []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put(filepath.Join(dir, "b"), "b"); err != nil {
+		t.Fatal(err)
+	}
+	writeReq := <-writeReqs
+	if len(writeReq.Negotiated) != 3 || writeReq.Negotiated["blksize"] != "1024" || writeReq.Negotiated["timeout"] != "1" || writeReq.Negotiated["tsize"] != "8" {
+		t.Errorf("write handler got negotiated options %v", writeReq.Negotiated)
+	}
+}
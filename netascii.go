@@ -0,0 +1,99 @@
+/* This file contains the netascii translation (RFC 1350, RFC 764) used by netascii mode transfers */
+/* On the wire every line ends with CR LF and a CR that is not followed by LF is sent as CR NUL */
+/* Locally lines end with LF. Both translations stream, so a CR LF pair may be split across data blocks */
+
+package tftp
+
+import "io"
+
+/* netasciiReader translates a local file into netascii as it is read */
+type netasciiReader struct {
+	r       io.Reader
+	buf     []byte
+	pending []byte /* Translated bytes that did not fit into the caller's buffer */
+	err     error
+}
+
+func newNetasciiReader(r io.Reader) *netasciiReader {
+	return &netasciiReader{r: r}
+}
+
+func (n *netasciiReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(n.pending) == 0 && n.err == nil {
+		if cap(n.buf) < len(p) {
+			n.buf = make([]byte, len(p))
+		}
+		count, err := n.r.Read(n.buf[:len(p)])
+		n.err = err
+		n.pending = n.pending[:0]
+		for _, c := range n.buf[:count] {
+			switch c {
+			case '\n':
+				n.pending = append(n.pending, '\r', '\n')
+			case '\r':
+				n.pending = append(n.pending, '\r', 0)
+			default:
+				n.pending = append(n.pending, c)
+			}
+		}
+	}
+	if len(n.pending) == 0 {
+		return 0, n.err
+	}
+	count := copy(p, n.pending)
+	n.pending = n.pending[count:]
+	return count, nil
+}
+
+/* netasciiWriter translates netascii back into a local file as it is written. */
+/* Close must be called after the last block, it writes a CR that ended the transfer */
+type netasciiWriter struct {
+	w  io.Writer
+	cr bool /* The last byte written was a CR whose meaning depends on the next byte */
+}
+
+func newNetasciiWriter(w io.Writer) *netasciiWriter {
+	return &netasciiWriter{w: w}
+}
+
+func (n *netasciiWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+1)
+	for _, c := range p {
+		if n.cr {
+			n.cr = false
+			switch c {
+			case '\n':
+				out = append(out, '\n')
+				continue
+			case 0:
+				out = append(out, '\r')
+				continue
+			}
+
+			/* A bare CR is not valid netascii. It is kept as it is rather than failing the transfer */
+
+			out = append(out, '\r')
+		}
+		if c == '\r' {
+			n.cr = true
+			continue
+		}
+		out = append(out, c)
+	}
+	if _, err := n.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (n *netasciiWriter) Close() error {
+	if !n.cr {
+		return nil
+	}
+	n.cr = false
+	_, err := n.w.Write([]byte{'\r'})
+	return err
+}
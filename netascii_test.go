@@ -0,0 +1,118 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestNetasciiReader(t *testing.T) {
+	tests := []struct {
+		local, wire string
+	}{
+		{"", ""},
+		{"line\n", "line\r\n"},
+		{"a\nb\n\n", "a\r\nb\r\n\r\n"},
+		{"bare\rcr", "bare\r\x00cr"},
+		{"crlf\r\n", "crlf\r\x00\r\n"},
+		{"\r", "\r\x00"},
+	}
+	for _, test := range tests {
+		got, err := io.ReadAll(newNetasciiReader(strings.NewReader(test.local)))
+		if err != nil || string(got) != test.wire {
+			t.Errorf("%q: read %q, %v, want %q", test.local, got, err, test.wire)
+		}
+
+		/* A caller reading one byte at a time gets the expanded CR LF and CR NUL pairs split across reads */
+
+		got, err = io.ReadAll(iotest.OneByteReader(newNetasciiReader(strings.NewReader(test.local))))
+		if err != nil || string(got) != test.wire {
+			t.Errorf("%q: read one byte at a time %q, %v, want %q", test.local, got, err, test.wire)
+		}
+	}
+}
+
+func TestNetasciiWriter(t *testing.T) {
+	tests := []struct {
+		wire  []string /* One Write call each */
+		local string
+	}{
+		{[]string{"line\r\n"}, "line\n"},
+		{[]string{"a\r\nb\r\n\r\n"}, "a\nb\n\n"},
+		{[]string{"bare\r\x00cr"}, "bare\rcr"},
+		{[]string{"split\r", "\nnext"}, "split\nnext"},
+		{[]string{"split\r", "\x00next"}, "split\rnext"},
+		{[]string{"\r", "\n", "\r", "\x00"}, "\n\r"},
+		{[]string{"invalid\rx"}, "invalid\rx"},
+		{[]string{"trailing\r"}, "trailing\r"},
+		{[]string{"trailing", "\r"}, "trailing\r"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		w := newNetasciiWriter(&out)
+		for _, block := range test.wire {
+			if n, err := w.Write([]byte(block)); n != len(block) || err != nil {
+				t.Errorf("%q: Write(%q) = %d, %v", test.wire, block, n, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("%q: Close: %v", test.wire, err)
+		}
+		if out.String() != test.local {
+			t.Errorf("%q: wrote %q, want %q", test.wire, out.String(), test.local)
+		}
+	}
+}
+
+/* TestNetasciiTransfer moves a file with every kind of line ending in netascii mode with 8 byte blocks, */
+/* so that CR LF and CR NUL pairs are split across blocks in both directions */
+func TestNetasciiTransfer(t *testing.T) {
+	dir := chdirTemp(t)
+	want := []byte(strings.Repeat("line\nbare\rcr\r\n\n\rx", 20) + "end\r")
+	if err := os.WriteFile(filepath.Join(dir, "text"), want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := newTestServer(t, &Server{})
+
+	/* The file goes over the wire translated */
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got, peer := exchange(t, conn, addr, []byte("\x00\x01text\x00netascii\x00"))
+	wire := strings.Repeat("line\r\nbare\r\x00cr\r\x00\r\n\r\n\r\x00x", 20) + "end\r\x00"
+	if !bytes.Equal(got, append([]byte("\x00\x03\x00\x01"), wire...)) {
+		t.Fatalf("DATA is %q, want %q", got, wire)
+	}
+	conn.WriteToUDP([]byte("\x00\x04\x00\x01"), peer)
+
+	c := &Client{Addr: addr.String(), Timeout: time.Second, Mode: "netascii", Options: map[string]string{"blksize": "8"}}
+	if err := c.Get("text", "copy"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "copy")); !bytes.Equal(got, want) {
+		t.Errorf("Get stored %q, want %q", got, want)
+	}
+	if err := c.Put("text", "upload"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, _ := os.ReadFile(filepath.Join(dir, "upload"))
+		if bytes.Equal(got, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Put stored %q, want %q", got, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
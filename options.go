@@ -0,0 +1,293 @@
+/* This file contains the option negotiation framework (RFC 2347) */
+/* Each option registers an optionHandler. Options without a handler are ignored by the server */
+/* and rejected by the client if they ever show up in an OACK */
+
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/* Time to wait for a packet before retransmitting, unless a different timeout is configured or negotiated (RFC 2349) */
+const defaultTimeout = 5 * time.Second
+
+/* The sender gives up after this many timeouts unless a RetryPolicy says otherwise */
+const senderRetries = 4
+
+/* Largest window the server agrees to, it bounds the memory held for retransmission to maxWindowSize blocks */
+const maxWindowSize = 64
+
+/* transferOptions holds the negotiated values that govern a single transfer */
+type transferOptions struct {
+	read            bool          /* true for a read request, false for a write request */
+	blockSize       int           /* Size of a full DATA block (blksize, RFC 2348) */
+	windowSize      int           /* Number of DATA blocks sent before waiting for an Ack (windowsize, RFC 7440) */
+	rollover        uint16        /* Block number that follows block 65535, 0 or 1 (rollover) */
+	timeout         time.Duration /* Retransmission timeout (timeout, RFC 2349) */
+	retry           RetryPolicy   /* Retransmissions, backoff and overall deadline of the transfer */
+	transferSize    int64         /* Size of the file, -1 if not known (tsize, RFC 2349) */
+	maxTransferSize int64         /* Largest file the server accepts on a write request, 0 for no limit */
+}
+
+/* newTransferOptions returns the values used when no option is negotiated */
+func newTransferOptions(read bool) *transferOptions {
+	return &transferOptions{read: read, blockSize: defaultBlockSize, windowSize: 1, timeout: defaultTimeout, transferSize: -1}
+}
+
+/* optionHandler implements one option on both sides of the negotiation */
+type optionHandler struct {
+
+	/* negotiate is called by the server with the value requested by the client. */
+	/* It applies the option to opts and returns the value to acknowledge in the OACK, or ok == false to ignore the option. */
+	/* A non nil error rejects the whole request */
+	negotiate func(opts *transferOptions, value string) (ack string, ok bool, err error)
+
+	/* accept is called by the client with the value acknowledged by the server and the value it had requested. */
+	/* It applies the option to opts, or returns an error if the acknowledged value is not acceptable */
+	accept func(opts *transferOptions, requested string, value string) error
+}
+
+var optionHandlers = map[string]optionHandler{}
+
+/* registerOption makes an option known to the server and the client. Names are lower case */
+func registerOption(name string, handler optionHandler) {
+	optionHandlers[name] = handler
+}
+
+/* negotiateOptions applies the options requested by a client to opts. */
+/* It returns the OACK to send, or nil if no option was accepted and the transfer must start without one */
+func negotiateOptions(requested map[string]string, opts *transferOptions) (*OptionAck, error) {
+	accepted := make(map[string]string)
+	for name, value := range requested {
+		handler, ok := optionHandlers[name]
+		if !ok {
+			continue
+		}
+		ack, ok, err := handler.negotiate(opts, value)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			accepted[name] = ack
+		}
+	}
+	if len(accepted) == 0 {
+		return nil, nil
+	}
+	return &OptionAck{Options: accepted}, nil
+}
+
+/* negotiatedOptions returns the options acknowledged by oack, which is nil if no option was accepted */
+func negotiatedOptions(oack *OptionAck) map[string]string {
+	if oack == nil {
+		return map[string]string{}
+	}
+	return oack.Options
+}
+
+/* mergeOptionAcks returns an OACK holding the options of both a and b, either of which may be nil. */
+/* The options of a are copied, so a map already handed out by negotiatedOptions is left unchanged */
+func mergeOptionAcks(a *OptionAck, b *OptionAck) *OptionAck {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	merged := make(map[string]string, len(a.Options)+len(b.Options))
+	for name, value := range a.Options {
+		merged[name] = value
+	}
+	for name, value := range b.Options {
+		merged[name] = value
+	}
+	return &OptionAck{Options: merged}
+}
+
+/* acceptOptions applies an OACK received by the client to opts. */
+/* The server may only acknowledge options that were requested, otherwise negotiation fails */
+func acceptOptions(requested map[string]string, oack *OptionAck, opts *transferOptions) error {
+	for name, value := range oack.Options {
+		requestedValue, ok := requested[name]
+		if !ok {
+			return &Error{Code: CodeOptionNegotiation, Message: fmt.Sprintf("option %q was not requested", name)}
+		}
+		handler, ok := optionHandlers[name]
+		if !ok {
+			continue
+		}
+		if err := handler.accept(opts, requestedValue, value); err != nil {
+			return &Error{Code: CodeOptionNegotiation, Message: err.Error()}
+		}
+	}
+	return nil
+}
+
+/* Block size option (RFC 2348). The server acknowledges a smaller size than requested if the request exceeds */
+/* maxBlockSize and ignores sizes below minBlockSize. The client accepts any valid size upto the one it requested */
+
+func init() {
+	registerOption("blksize", optionHandler{
+		negotiate: func(opts *transferOptions, value string) (string, bool, error) {
+			size, err := strconv.Atoi(value)
+			if err != nil || size < minBlockSize {
+				return "", false, nil
+			}
+			if size > maxBlockSize {
+				size = maxBlockSize
+			}
+			opts.blockSize = size
+			return strconv.Itoa(size), true, nil
+		},
+		accept: func(opts *transferOptions, requested string, value string) error {
+			size, err := strconv.Atoi(value)
+			if err != nil || size < minBlockSize || size > maxBlockSize {
+				return fmt.Errorf("invalid blksize %q", value)
+			}
+			if requestedSize, err := strconv.Atoi(requested); err == nil && size > requestedSize {
+				return fmt.Errorf("blksize %d is larger than the requested %d", size, requestedSize)
+			}
+			opts.blockSize = size
+			return nil
+		},
+	})
+}
+
+/* Transfer size option (RFC 2349). On a read request the client sends 0 and the server answers with the size of the file. */
+/* On a write request the client sends the size of the file and the server refuses it with Disk full if it is too large */
+
+func init() {
+	registerOption("tsize", optionHandler{
+		negotiate: func(opts *transferOptions, value string) (string, bool, error) {
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return "", false, nil
+			}
+			if opts.read {
+				if opts.transferSize < 0 {
+					return "", false, nil
+				}
+				return strconv.FormatInt(opts.transferSize, 10), true, nil
+			}
+			if opts.maxTransferSize > 0 && size > opts.maxTransferSize {
+				return "", false, &Error{Code: CodeDiskFull, Message: fmt.Sprintf("File is larger than %d bytes", opts.maxTransferSize)}
+			}
+			opts.transferSize = size
+			return value, true, nil
+		},
+		accept: func(opts *transferOptions, requested string, value string) error {
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return fmt.Errorf("invalid tsize %q", value)
+			}
+			opts.transferSize = size
+			return nil
+		},
+	})
+}
+
+/* Timeout option (RFC 2349). The value is in seconds from 1 to 255 and the server must acknowledge it unchanged */
+
+func init() {
+	registerOption("timeout", optionHandler{
+		negotiate: func(opts *transferOptions, value string) (string, bool, error) {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 1 || seconds > 255 {
+				return "", false, nil
+			}
+			opts.timeout = time.Duration(seconds) * time.Second
+			return value, true, nil
+		},
+		accept: func(opts *transferOptions, requested string, value string) error {
+			if value != requested {
+				return fmt.Errorf("timeout %q does not match the requested %q", value, requested)
+			}
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 1 || seconds > 255 {
+				return fmt.Errorf("invalid timeout %q", value)
+			}
+			opts.timeout = time.Duration(seconds) * time.Second
+			return nil
+		},
+	})
+}
+
+/* timeoutOption returns the value of the timeout option for d, rounded to whole seconds from 1 to 255 */
+func timeoutOption(d time.Duration) string {
+	seconds := int((d + time.Second/2) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	if seconds > 255 {
+		seconds = 255
+	}
+	return strconv.Itoa(seconds)
+}
+
+/* Window size option (RFC 7440). The server acknowledges a smaller window than requested if the request exceeds */
+/* maxWindowSize. The client accepts any window from 1 upto the one it requested */
+
+func init() {
+	registerOption("windowsize", optionHandler{
+		negotiate: func(opts *transferOptions, value string) (string, bool, error) {
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 1 || size > 65535 {
+				return "", false, nil
+			}
+			if size > maxWindowSize {
+				size = maxWindowSize
+			}
+			opts.windowSize = size
+			return strconv.Itoa(size), true, nil
+		},
+		accept: func(opts *transferOptions, requested string, value string) error {
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 1 || size > 65535 {
+				return fmt.Errorf("invalid windowsize %q", value)
+			}
+			if requestedSize, err := strconv.Atoi(requested); err == nil && size > requestedSize {
+				return fmt.Errorf("windowsize %d is larger than the requested %d", size, requestedSize)
+			}
+			opts.windowSize = size
+			return nil
+		},
+	})
+}
+
+/* Block number rollover option. Not part of any RFC, it is understood by tftp-hpa and U-Boot. */
+/* The value is the block number that follows block 65535, 0 or 1. Without it blocks wrap to 0 */
+
+var errRollover = errors.New("tftp: rollover must be 0 or 1")
+
+/* checkRollover validates a configured rollover, since blocks past 65535 would be numbered wrongly otherwise */
+func checkRollover(rollover uint16) error {
+	if rollover > 1 {
+		return errRollover
+	}
+	return nil
+}
+
+func init() {
+	registerOption("rollover", optionHandler{
+		negotiate: func(opts *transferOptions, value string) (string, bool, error) {
+			if value != "0" && value != "1" {
+				return "", false, nil
+			}
+			opts.rollover = uint16(value[0] - '0')
+			return value, true, nil
+		},
+		accept: func(opts *transferOptions, requested string, value string) error {
+			if value != requested {
+				return fmt.Errorf("rollover %q does not match the requested %q", value, requested)
+			}
+			if value != "0" && value != "1" {
+				return fmt.Errorf("invalid rollover %q", value)
+			}
+			opts.rollover = uint16(value[0] - '0')
+			return nil
+		},
+	})
+}
@@ -0,0 +1,265 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNegotiateOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		read      bool
+		requested map[string]string
+		want      map[string]string      /* nil if the transfer starts without an OACK */
+		code      ErrorCode              /* non zero if the request is rejected */
+		before    func(*transferOptions) /* sets up what the server knows before negotiating */
+		set       func(*transferOptions) /* applies the negotiated values to the defaults */
+	}{
+		{name: "no options", read: true},
+		{name: "unknown option", read: true, requested: map[string]string{"x-unknown": "1"}},
+		{name: "unknown option on write", requested: map[string]string{"x-unknown": "1"}},
+		{
+			name: "blksize", read: true,
+			requested: map[string]string{"blksize": "1428", "x-unknown": "1"},
+			want:      map[string]string{"blksize": "1428"},
+			set:       func(o *transferOptions) { o.blockSize = 1428 },
+		},
+		{
+			name: "blksize above the maximum", read: true,
+			requested: map[string]string{"blksize": "70000"},
+			want:      map[string]string{"blksize": "65464"},
+			set:       func(o *transferOptions) { o.blockSize = 65464 },
+		},
+		{name: "blksize below the minimum", read: true, requested: map[string]string{"blksize": "7"}},
+		{name: "blksize not a number", requested: map[string]string{"blksize": "big"}},
+		{
+			name: "tsize on read", read: true,
+			requested: map[string]string{"tsize": "0"},
+			want:      map[string]string{"tsize": "1234"},
+			before:    func(o *transferOptions) { o.transferSize = 1234 },
+		},
+		{name: "tsize on read of unknown size", read: true, requested: map[string]string{"tsize": "0"}},
+		{
+			name:      "tsize on write",
+			requested: map[string]string{"tsize": "600"},
+			want:      map[string]string{"tsize": "600"},
+			before:    func(o *transferOptions) { o.maxTransferSize = 1000 },
+			set:       func(o *transferOptions) { o.transferSize = 600 },
+		},
+		{
+			name:      "tsize on write above the limit",
+			requested: map[string]string{"tsize": "600", "blksize": "1024"},
+			before:    func(o *transferOptions) { o.maxTransferSize = 100 },
+			code:      CodeDiskFull,
+		},
+		{
+			name: "timeout", read: true,
+			requested: map[string]string{"timeout": "2"},
+			want:      map[string]string{"timeout": "2"},
+			set:       func(o *transferOptions) { o.timeout = 2 * time.Second },
+		},
+		{name: "timeout zero", read: true, requested: map[string]string{"timeout": "0"}},
+		{name: "timeout too large", requested: map[string]string{"timeout": "256"}},
+		{
+			name: "windowsize", read: true,
+			requested: map[string]string{"windowsize": "8"},
+			want:      map[string]string{"windowsize": "8"},
+			set:       func(o *transferOptions) { o.windowSize = 8 },
+		},
+		{
+			name:      "windowsize above the maximum",
+			requested: map[string]string{"windowsize": "1000"},
+			want:      map[string]string{"windowsize": strconv.Itoa(maxWindowSize)},
+			set:       func(o *transferOptions) { o.windowSize = maxWindowSize },
+		},
+		{name: "windowsize zero", read: true, requested: map[string]string{"windowsize": "0"}},
+	}
+	for _, test := range tests {
+		opts := newTransferOptions(test.read)
+		if test.before != nil {
+			test.before(opts)
+		}
+		oack, err := negotiateOptions(test.requested, opts)
+		if test.code != 0 {
+			var tftpErr *Error
+			if !errors.As(err, &tftpErr) || tftpErr.Code != test.code {
+				t.Errorf("%s: got error %v, want code %d", test.name, err, test.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		var got map[string]string
+		if oack != nil {
+			got = oack.Options
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: acknowledged %v, want %v", test.name, got, test.want)
+		}
+		want := newTransferOptions(test.read)
+		if test.before != nil {
+			test.before(want)
+		}
+		if test.set != nil {
+			test.set(want)
+		}
+		if !reflect.DeepEqual(opts, want) {
+			t.Errorf("%s: negotiated %+v, want %+v", test.name, *opts, *want)
+		}
+	}
+}
+
+func TestAcceptOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested map[string]string
+		oack      map[string]string
+		code      ErrorCode              /* non zero if the client must refuse the OACK */
+		set       func(*transferOptions) /* applies the accepted values to the defaults */
+	}{
+		{name: "empty OACK", requested: map[string]string{"x-unknown": "1"}},
+		{name: "option not requested", oack: map[string]string{"x-unknown": "1"}, code: CodeOptionNegotiation},
+		{name: "blksize not requested", oack: map[string]string{"blksize": "512"}, code: CodeOptionNegotiation},
+		{
+			name:      "smaller blksize",
+			requested: map[string]string{"blksize": "1428"},
+			oack:      map[string]string{"blksize": "1024"},
+			set:       func(o *transferOptions) { o.blockSize = 1024 },
+		},
+		{name: "larger blksize", requested: map[string]string{"blksize": "1024"}, oack: map[string]string{"blksize": "1428"}, code: CodeOptionNegotiation},
+		{name: "blksize below the minimum", requested: map[string]string{"blksize": "1024"}, oack: map[string]string{"blksize": "4"}, code: CodeOptionNegotiation},
+		{
+			name:      "tsize",
+			requested: map[string]string{"tsize": "0"},
+			oack:      map[string]string{"tsize": "1234"},
+			set:       func(o *transferOptions) { o.transferSize = 1234 },
+		},
+		{
+			name:      "timeout",
+			requested: map[string]string{"timeout": "2"},
+			oack:      map[string]string{"timeout": "2"},
+			set:       func(o *transferOptions) { o.timeout = 2 * time.Second },
+		},
+		{name: "changed timeout", requested: map[string]string{"timeout": "2"}, oack: map[string]string{"timeout": "3"}, code: CodeOptionNegotiation},
+		{
+			name:      "smaller windowsize",
+			requested: map[string]string{"windowsize": "128"},
+			oack:      map[string]string{"windowsize": "64"},
+			set:       func(o *transferOptions) { o.windowSize = 64 },
+		},
+		{name: "larger windowsize", requested: map[string]string{"windowsize": "4"}, oack: map[string]string{"windowsize": "8"}, code: CodeOptionNegotiation},
+	}
+	for _, test := range tests {
+		opts := newTransferOptions(true)
+		err := acceptOptions(test.requested, &OptionAck{Options: test.oack}, opts)
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			want := newTransferOptions(true)
+			if test.set != nil {
+				test.set(want)
+			}
+			if !reflect.DeepEqual(opts, want) {
+				t.Errorf("%s: accepted %+v, want %+v", test.name, *opts, *want)
+			}
+			continue
+		}
+		var tftpErr *Error
+		if !errors.As(err, &tftpErr) || tftpErr.Code != test.code {
+			t.Errorf("%s: got error %v, want code %d", test.name, err, test.code)
+		}
+	}
+}
+
+/* TestNoOptionAccepted checks that a request whose options are all ignored starts with DATA 1 or Ack 0, not an OACK */
+func TestNoOptionAccepted(t *testing.T) {
+	dir := chdirTemp(t)
+	if err := os.WriteFile(filepath.Join(dir, "boot"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := newTestServer(t, &Server{})
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	got, peer := exchange(t, conn, addr, []byte("\x00\x01boot\x00octet\x00x-unknown\x001\x00"))
+	if want := []byte("\x00\x03\x00\x01hello"); !bytes.Equal(got, want) {
+		t.Fatalf("RRQ answered with %q, want %q", got, want)
+	}
+	conn.WriteToUDP([]byte("\x00\x04\x00\x01"), peer)
+
+	got, peer = exchange(t, conn, addr, []byte("\x00\x02upload\x00octet\x00x-unknown\x001\x00"))
+	if want := []byte("\x00\x04\x00\x00"); !bytes.Equal(got, want) {
+		t.Fatalf("WRQ answered with %q, want %q", got, want)
+	}
+	conn.WriteToUDP([]byte("\x00\x05\x00\x00\x00"), peer)
+}
+
+func TestInvalidRollover(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Rollover: 5}
+	if err := s.Serve(conn); err != errRollover {
+		t.Errorf("Serve returned %v", err)
+	}
+	c := &Client{Addr: conn.LocalAddr().String(), Rollover: 2}
+	if err := c.Get("a", t.TempDir()+"/a"); err != errRollover {
+		t.Errorf("Get returned %v", err)
+	}
+	if err := c.Put("a", "a"); err != errRollover {
+		t.Errorf("Put returned %v", err)
+	}
+}
+
+/* TestRolloverTransfer moves a file of more than 65536 blocks in both directions, */
+/* so that the block number wraps to the negotiated value */
+func TestRolloverTransfer(t *testing.T) {
+	dir := chdirTemp(t)
+	want := make([]byte, 530000)
+	for i := range want {
+		want[i] = byte(i / 8)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "big"), want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := newTestServer(t, &Server{})
+	for _, rollover := range []uint16{0, 1} {
+		c := &Client{Addr: addr.String(), Timeout: time.Second, Rollover: rollover, Options: map[string]string{"blksize": "8"}}
+		copyName := "copy" + strconv.Itoa(int(rollover))
+		if err := c.Get("big", copyName); err != nil {
+			t.Fatalf("rollover %d: Get: %v", rollover, err)
+		}
+		if got, _ := os.ReadFile(filepath.Join(dir, copyName)); !bytes.Equal(got, want) {
+			t.Errorf("rollover %d: Get stored %d bytes, want %d", rollover, len(got), len(want))
+		}
+		putName := "put" + strconv.Itoa(int(rollover))
+		if err := c.Put("big", putName); err != nil {
+			t.Fatalf("rollover %d: Put: %v", rollover, err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			got, _ := os.ReadFile(filepath.Join(dir, putName))
+			if bytes.Equal(got, want) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("rollover %d: Put stored %d bytes, want %d", rollover, len(got), len(want))
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
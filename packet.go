@@ -0,0 +1,378 @@
+/* This file contains the TFTP packet types and their wire encoding */
+/* Every packet starts with a 2 byte opcode in network byte order (RFC 1350) */
+
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	opRRQ   uint16 = 1 /* Read request */
+	opWRQ   uint16 = 2 /* Write request */
+	opDATA  uint16 = 3 /* Data */
+	opACK   uint16 = 4 /* Acknowledgment */
+	opERROR uint16 = 5 /* Error */
+	opOACK  uint16 = 6 /* Option acknowledgment (RFC 2347) */
+)
+
+/* Data payload carried by a full DATA packet unless a different blksize is negotiated (RFC 2348) */
+const (
+	defaultBlockSize = 512
+	minBlockSize     = 8
+	maxBlockSize     = 65464
+)
+
+/* Largest request or acknowledgment packet that can be received */
+const maxPacketSize = 4 + defaultBlockSize
+
+var errShortPacket = errors.New("tftp: packet too short")
+
+/* packet is implemented by every TFTP packet type */
+type packet interface {
+	MarshalBinary() ([]byte, error)
+	UnmarshalBinary(b []byte) error
+}
+
+/* Transfer modes. Modes are case insensitive on the wire and are always stored in lower case */
+const (
+	modeNetascii = "netascii"
+	modeOctet    = "octet"
+	modeMail     = "mail"
+)
+
+/* ReadRequest (RRQ) - 2 byte opcode, n byte filename, 0, mode, 0, followed by option, 0, value, 0 pairs */
+/* Option names are case insensitive (RFC 2347) and are always stored in lower case */
+type ReadRequest struct {
+	Filename string
+	Mode     string
+	Options  map[string]string
+}
+
+/* WriteRequest (WRQ) - same layout as ReadRequest */
+type WriteRequest struct {
+	Filename string
+	Mode     string
+	Options  map[string]string
+}
+
+/* Data - 2 byte opcode, 2 byte block number, upto 512 bytes of data or the negotiated block size */
+type Data struct {
+	Block uint16
+	Data  []byte
+}
+
+/* Ack - 2 byte opcode, 2 byte block number */
+type Ack struct {
+	Block uint16
+}
+
+/* ErrorPacket - 2 byte opcode, 2 byte error number, n byte error message, 0 */
+type ErrorPacket struct {
+	Code    ErrorCode
+	Message string
+}
+
+/* OptionAck (OACK) - 2 byte opcode, followed by option, 0, value, 0 pairs */
+type OptionAck struct {
+	Options map[string]string
+}
+
+func (p *ReadRequest) MarshalBinary() ([]byte, error) {
+	return marshalRequest(opRRQ, p.Filename, p.Mode, p.Options)
+}
+
+func (p *ReadRequest) UnmarshalBinary(b []byte) error {
+	var err error
+	p.Filename, p.Mode, p.Options, err = unmarshalRequest(opRRQ, b)
+	return err
+}
+
+func (p *WriteRequest) MarshalBinary() ([]byte, error) {
+	return marshalRequest(opWRQ, p.Filename, p.Mode, p.Options)
+}
+
+func (p *WriteRequest) UnmarshalBinary(b []byte) error {
+	var err error
+	p.Filename, p.Mode, p.Options, err = unmarshalRequest(opWRQ, b)
+	return err
+}
+
+func marshalRequest(opcode uint16, fileName string, mode string, options map[string]string) ([]byte, error) {
+	if fileName == "" {
+		return nil, errors.New("tftp: empty filename")
+	}
+	if mode == "" {
+		mode = modeOctet
+	}
+	mode, err := parseMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkString(fileName); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 2, 4+len(fileName)+len(mode))
+	binary.BigEndian.PutUint16(b, opcode)
+	b = append(b, fileName...)
+	b = append(b, 0)
+	b = append(b, mode...)
+	b = append(b, 0)
+	return appendOptions(b, options)
+}
+
+/* unmarshalRequest splits a request into its NUL terminated fields. */
+/* Anything after the mode must be complete option and value pairs */
+func unmarshalRequest(opcode uint16, b []byte) (string, string, map[string]string, error) {
+	if err := checkOpcode(b, opcode, 2); err != nil {
+		return "", "", nil, err
+	}
+	fields, err := splitStrings(b[2:])
+	if err != nil {
+		return "", "", nil, err
+	}
+	if len(fields) < 2 {
+		return "", "", nil, errors.New("tftp: request has no transfer mode")
+	}
+	if fields[0] == "" {
+		return "", "", nil, errors.New("tftp: request has an empty filename")
+	}
+	mode, err := parseMode(fields[1])
+	if err != nil {
+		return "", "", nil, err
+	}
+	options, err := parseOptions(fields[2:])
+	if err != nil {
+		return "", "", nil, err
+	}
+	return fields[0], mode, options, nil
+}
+
+/* parseMode returns the lower case form of a known transfer mode */
+func parseMode(mode string) (string, error) {
+	switch m := strings.ToLower(mode); m {
+	case modeNetascii, modeOctet, modeMail:
+		return m, nil
+	}
+	return "", fmt.Errorf("tftp: unknown transfer mode %q", mode)
+}
+
+/* parseOptions turns option, value pairs into a map keyed by lower case option name */
+func parseOptions(fields []string) (map[string]string, error) {
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("tftp: option %q has no value", fields[len(fields)-1])
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	options := make(map[string]string, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		name := strings.ToLower(fields[i])
+		if name == "" {
+			return nil, errors.New("tftp: empty option name")
+		}
+		if _, ok := options[name]; ok {
+			return nil, fmt.Errorf("tftp: option %q is repeated", name)
+		}
+		options[name] = fields[i+1]
+	}
+	return options, nil
+}
+
+/* appendOptions appends option, 0, value, 0 pairs to b in option name order */
+func appendOptions(b []byte, options map[string]string) ([]byte, error) {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := options[name]
+		if name == "" {
+			return nil, errors.New("tftp: empty option name")
+		}
+		if err := checkString(name); err != nil {
+			return nil, err
+		}
+		if err := checkString(value); err != nil {
+			return nil, err
+		}
+		b = append(b, name...)
+		b = append(b, 0)
+		b = append(b, value...)
+		b = append(b, 0)
+	}
+	return b, nil
+}
+
+func (p *Data) MarshalBinary() ([]byte, error) {
+	if len(p.Data) > maxBlockSize {
+		return nil, fmt.Errorf("tftp: data block of %d bytes is too large", len(p.Data))
+	}
+	b := make([]byte, 4+len(p.Data))
+	binary.BigEndian.PutUint16(b, opDATA)
+	binary.BigEndian.PutUint16(b[2:], p.Block)
+	copy(b[4:], p.Data)
+	return b, nil
+}
+
+func (p *Data) UnmarshalBinary(b []byte) error {
+	if err := checkOpcode(b, opDATA, 4); err != nil {
+		return err
+	}
+	if len(b)-4 > maxBlockSize {
+		return fmt.Errorf("tftp: data block of %d bytes is too large", len(b)-4)
+	}
+	p.Block = binary.BigEndian.Uint16(b[2:])
+	p.Data = append([]byte(nil), b[4:]...)
+	return nil
+}
+
+func (p *Ack) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint16(b, opACK)
+	binary.BigEndian.PutUint16(b[2:], p.Block)
+	return b, nil
+}
+
+func (p *Ack) UnmarshalBinary(b []byte) error {
+	if err := checkOpcode(b, opACK, 4); err != nil {
+		return err
+	}
+	if len(b) != 4 {
+		return fmt.Errorf("tftp: ACK packet has %d bytes", len(b))
+	}
+	p.Block = binary.BigEndian.Uint16(b[2:])
+	return nil
+}
+
+func (p *ErrorPacket) MarshalBinary() ([]byte, error) {
+	if err := checkString(p.Message); err != nil {
+		return nil, err
+	}
+	b := make([]byte, 4, 5+len(p.Message))
+	binary.BigEndian.PutUint16(b, opERROR)
+	binary.BigEndian.PutUint16(b[2:], uint16(p.Code))
+	b = append(b, p.Message...)
+	b = append(b, 0)
+	return b, nil
+}
+
+func (p *ErrorPacket) UnmarshalBinary(b []byte) error {
+	if err := checkOpcode(b, opERROR, 5); err != nil {
+		return err
+	}
+	fields, err := splitStrings(b[4:])
+	if err != nil {
+		return err
+	}
+	if len(fields) != 1 {
+		return errors.New("tftp: malformed ERROR packet")
+	}
+	p.Code = ErrorCode(binary.BigEndian.Uint16(b[2:]))
+	p.Message = fields[0]
+	return nil
+}
+
+func (p *OptionAck) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, opOACK)
+	return appendOptions(b, p.Options)
+}
+
+func (p *OptionAck) UnmarshalBinary(b []byte) error {
+	if err := checkOpcode(b, opOACK, 2); err != nil {
+		return err
+	}
+	fields, err := splitStrings(b[2:])
+	if err != nil {
+		return err
+	}
+	p.Options, err = parseOptions(fields)
+	return err
+}
+
+/* parsePacket decodes b into the packet type given by its opcode */
+func parsePacket(b []byte) (packet, error) {
+	if len(b) < 2 {
+		return nil, errShortPacket
+	}
+	var p packet
+	switch binary.BigEndian.Uint16(b) {
+	case opRRQ:
+		p = &ReadRequest{}
+	case opWRQ:
+		p = &WriteRequest{}
+	case opDATA:
+		p = &Data{}
+	case opACK:
+		p = &Ack{}
+	case opERROR:
+		p = &ErrorPacket{}
+	case opOACK:
+		p = &OptionAck{}
+	default:
+		return nil, fmt.Errorf("tftp: unknown opcode %d", binary.BigEndian.Uint16(b))
+	}
+	if err := p.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func checkOpcode(b []byte, opcode uint16, minLen int) error {
+	if len(b) < minLen {
+		return errShortPacket
+	}
+	if got := binary.BigEndian.Uint16(b); got != opcode {
+		return fmt.Errorf("tftp: opcode %d, expected %d", got, opcode)
+	}
+	return nil
+}
+
+/* splitStrings splits a sequence of NUL terminated strings */
+func splitStrings(b []byte) ([]string, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	if b[len(b)-1] != 0 {
+		return nil, errors.New("tftp: string is not NUL terminated")
+	}
+	parts := bytes.Split(b[:len(b)-1], []byte{0})
+	fields := make([]string, len(parts))
+	for i, part := range parts {
+		fields[i] = string(part)
+	}
+	return fields, nil
+}
+
+func checkString(s string) error {
+	if bytes.IndexByte([]byte(s), 0) >= 0 {
+		return fmt.Errorf("tftp: %q contains a NUL byte", s)
+	}
+	return nil
+}
+
+/* packetName returns the name used for p in RFC 1350 */
+func packetName(p packet) string {
+	switch p.(type) {
+	case *ReadRequest:
+		return "RRQ"
+	case *WriteRequest:
+		return "WRQ"
+	case *Data:
+		return "DATA"
+	case *Ack:
+		return "ACK"
+	case *ErrorPacket:
+		return "ERROR"
+	case *OptionAck:
+		return "OACK"
+	}
+	return "unknown"
+}
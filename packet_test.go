@@ -0,0 +1,276 @@
+package tftp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/* Datagrams in the form tftp-hpa 5.2 and atftp 0.7 put on the wire. Multi-byte fields are in network byte order */
+
+var interopPackets = []struct {
+	name   string
+	wire   []byte
+	packet packet
+}{
+	{
+		name:   "tftp-hpa RRQ",
+		wire:   []byte("\x00\x01pxelinux.0\x00octet\x00"),
+		packet: &ReadRequest{Filename: "pxelinux.0", Mode: "octet"},
+	},
+	{
+		name:   "tftp-hpa RRQ netascii",
+		wire:   []byte("\x00\x01boot.msg\x00netascii\x00"),
+		packet: &ReadRequest{Filename: "boot.msg", Mode: "netascii"},
+	},
+	{
+		name:   "atftp RRQ with options",
+		wire:   []byte("\x00\x01vmlinuz\x00octet\x00tsize\x000\x00blksize\x001428\x00"),
+		packet: &ReadRequest{Filename: "vmlinuz", Mode: "octet", Options: map[string]string{"tsize": "0", "blksize": "1428"}},
+	},
+	{
+		name:   "atftp WRQ",
+		wire:   []byte("\x00\x02upload.bin\x00octet\x00"),
+		packet: &WriteRequest{Filename: "upload.bin", Mode: "octet"},
+	},
+	{
+		name:   "tftp-hpa DATA block 1",
+		wire:   []byte("\x00\x03\x00\x01hello"),
+		packet: &Data{Block: 1, Data: []byte("hello")},
+	},
+	{
+		name:   "tftp-hpa DATA block 258",
+		wire:   []byte("\x00\x03\x01\x02x"),
+		packet: &Data{Block: 258, Data: []byte("x")},
+	},
+	{
+		name:   "tftp-hpa empty last DATA",
+		wire:   []byte("\x00\x03\x00\x02"),
+		packet: &Data{Block: 2},
+	},
+	{
+		name:   "atftp ACK block 0",
+		wire:   []byte("\x00\x04\x00\x00"),
+		packet: &Ack{Block: 0},
+	},
+	{
+		name:   "atftp ACK block 65535",
+		wire:   []byte("\x00\x04\xff\xff"),
+		packet: &Ack{Block: 65535},
+	},
+	{
+		name:   "tftp-hpa ERROR file not found",
+		wire:   []byte("\x00\x05\x00\x01File not found\x00"),
+		packet: &ErrorPacket{Code: CodeFileNotFound, Message: "File not found"},
+	},
+	{
+		name:   "atftp ERROR option negotiation",
+		wire:   []byte("\x00\x05\x00\x08Failure to negotiate RFC1782 options\x00"),
+		packet: &ErrorPacket{Code: CodeOptionNegotiation, Message: "Failure to negotiate RFC1782 options"},
+	},
+	{
+		name:   "atftpd OACK",
+		wire:   []byte("\x00\x06tsize\x0012345\x00blksize\x001428\x00"),
+		packet: &OptionAck{Options: map[string]string{"tsize": "12345", "blksize": "1428"}},
+	},
+}
+
+func TestInteropDecode(t *testing.T) {
+	for _, test := range interopPackets {
+		p, err := parsePacket(test.wire)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, test.packet) {
+			t.Errorf("%s: decoded %#v, want %#v", test.name, p, test.packet)
+		}
+	}
+}
+
+func TestInteropEncode(t *testing.T) {
+	for _, test := range interopPackets {
+		b, err := test.packet.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		/* Options are written in a fixed order that may differ from the peer's, so packets with */
+		/* more than one option are compared after decoding them again */
+
+		if bytes.Equal(b, test.wire) {
+			continue
+		}
+		p, err := parsePacket(b)
+		if err != nil || !reflect.DeepEqual(p, test.packet) || len(b) != len(test.wire) {
+			t.Errorf("%s: encoded %q, want %q", test.name, b, test.wire)
+		}
+	}
+}
+
+/* exchange sends b from conn to addr and returns the answer and where it came from */
+func exchange(t *testing.T, conn *net.UDPConn, addr *net.UDPAddr, b []byte) ([]byte, *net.UDPAddr) {
+	t.Helper()
+	if _, err := conn.WriteToUDP(b, addr); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n], from
+}
+
+/* TestInteropTransfer plays the client side of a tftp-hpa transfer against the server byte for byte */
+func TestInteropTransfer(t *testing.T) {
+	dir := chdirTemp(t)
+	if err := os.WriteFile(filepath.Join(dir, "pxelinux.0"), bytes.Repeat([]byte{0xA5}, 600), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := newTestServer(t, &Server{})
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	got, peer := exchange(t, conn, addr, []byte("\x00\x01pxelinux.0\x00octet\x00"))
+	if want := append([]byte("\x00\x03\x00\x01"), bytes.Repeat([]byte{0xA5}, 512)...); !bytes.Equal(got, want) {
+		t.Fatalf("first DATA is %q", got)
+	}
+	got, _ = exchange(t, conn, peer, []byte("\x00\x04\x00\x01"))
+	if want := append([]byte("\x00\x03\x00\x02"), bytes.Repeat([]byte{0xA5}, 88)...); !bytes.Equal(got, want) {
+		t.Fatalf("second DATA is %q", got)
+	}
+	conn.WriteToUDP([]byte("\x00\x04\x00\x02"), peer)
+
+	got, _ = exchange(t, conn, addr, []byte("\x00\x01missing\x00octet\x00"))
+	if want := []byte("\x00\x05\x00\x01File not found\x00"); !bytes.Equal(got, want) {
+		t.Fatalf("ERROR is %q", got)
+	}
+}
+
+func TestRejectMalformedRequest(t *testing.T) {
+	addr := newTestServer(t, &Server{})
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, request := range []string{
+		"\x00\x01file\x00",
+		"\x00\x01file\x00binary\x00",
+		"\x00\x01\x00octet\x00",
+		"\x00\x02file\x00octet\x00blksize\x00",
+		"\x00\x02file\x00octet\x00blksize\x00512\x00BLKSIZE\x00512\x00",
+		"\x00\x01file\x00MAIL\x00",
+	} {
+		got, _ := exchange(t, conn, addr, []byte(request))
+		if !bytes.HasPrefix(got, []byte("\x00\x05\x00\x04")) {
+			t.Errorf("%q: answered with %q, want an Illegal TFTP operation error", request, got)
+		}
+	}
+}
+
+/* TestInteropClientRead drives Client.Get against a fake tftp-hpa server, which answers */
+/* the request from a new port with fixed DATA datagrams and checks the client's ACKs byte for byte */
+func TestInteropClientRead(t *testing.T) {
+	t.Parallel()
+	control, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer control.Close()
+	data, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	block1 := append([]byte("\x00\x03\x00\x01"), bytes.Repeat([]byte{0x5A}, 512)...)
+	block2 := []byte("\x00\x03\x00\x02tail")
+	served := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		control.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, client, err := control.ReadFromUDP(buf)
+		if err != nil {
+			served <- err
+			return
+		}
+		if want := []byte("\x00\x01pxelinux.0\x00octet\x00"); !bytes.Equal(buf[:n], want) {
+			served <- fmt.Errorf("RRQ is %q", buf[:n])
+			return
+		}
+		for _, step := range []struct{ data, ack []byte }{
+			{block1, []byte("\x00\x04\x00\x01")},
+			{block2, []byte("\x00\x04\x00\x02")},
+		} {
+			data.WriteToUDP(step.data, client)
+			data.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := data.ReadFromUDP(buf)
+			if err != nil {
+				served <- err
+				return
+			}
+			if !bytes.Equal(buf[:n], step.ack) {
+				served <- fmt.Errorf("ACK is %q", buf[:n])
+				return
+			}
+		}
+		served <- nil
+	}()
+
+	local := filepath.Join(t.TempDir(), "pxelinux.0")
+	c := &Client{Addr: control.LocalAddr().String()}
+	if err := c.Get("pxelinux.0", local); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(bytes.Repeat([]byte{0x5A}, 512), "tail"...); !bytes.Equal(got, want) {
+		t.Fatalf("stored %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func FuzzParsePacket(f *testing.F) {
+	for _, test := range interopPackets {
+		f.Add(test.wire)
+		f.Add(test.wire[:len(test.wire)-1])
+		f.Add(test.wire[:3])
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0})
+	f.Add([]byte("\x00\x01a\x00octet\x00blksize\x00"))
+	f.Add([]byte("\x00\x02a\x00mail\x00tsize\x00-1\x00tsize\x001\x00"))
+	f.Add([]byte("\x00\x05\x00\x09no terminator"))
+	f.Add([]byte("\x00\x06\x00"))
+	f.Add([]byte("\x00\x07\x00\x01"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p, err := parsePacket(b)
+		if err != nil {
+			return
+		}
+		encoded, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatalf("decoded %#v cannot be encoded: %v", p, err)
+		}
+		again, err := parsePacket(encoded)
+		if err != nil || !reflect.DeepEqual(p, again) {
+			t.Fatalf("decoded %#v, encoded and decoded again %#v, %v", p, again, err)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+//go:build linux
+
+/* This file contains the Linux support for learning the local address a request arrived on (IP_PKTINFO, IPV6_PKTINFO) */
+/* A server listening on all addresses uses it to send the replies of a transfer from that address */
+
+package tftp
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+/* Room for an IPv4 or IPv6 packet info control message */
+const packetInfoSize = 128
+
+/* enablePacketInfo asks the kernel to report the destination address of every packet received on conn. */
+/* Both options are set so that IPv4 packets on a dual-stack socket are reported too. Failures are ignored, */
+/* replies are then sent from the address picked by the routing table */
+func enablePacketInfo(conn *net.UDPConn) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	rawConn.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+	})
+}
+
+/* packetDestination returns the destination address found in the control messages of a received packet, */
+/* or nil if there is none. Link-local IPv6 addresses carry the index of the receiving interface as their zone */
+func packetDestination(oob []byte) *net.UDPAddr {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		switch {
+
+		/* struct in_pktinfo - 4 byte interface index, 4 byte local address, 4 byte header destination address */
+		/* The local address (ipi_spec_dst) is the one to reply from. The header destination may be a broadcast address */
+
+		case msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == syscall.IP_PKTINFO && len(msg.Data) >= 12:
+			return &net.UDPAddr{IP: net.IP(append([]byte(nil), msg.Data[4:8]...))}
+
+		/* struct in6_pktinfo - 16 byte destination address, 4 byte interface index */
+
+		case msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_PKTINFO && len(msg.Data) >= 20:
+			addr := &net.UDPAddr{IP: net.IP(append([]byte(nil), msg.Data[:16]...))}
+			if addr.IP.IsMulticast() {
+				return nil
+			}
+			if addr.IP.IsLinkLocalUnicast() {
+				addr.Zone = strconv.Itoa(int(binary.NativeEndian.Uint32(msg.Data[16:20])))
+			}
+			return addr
+		}
+	}
+	return nil
+}
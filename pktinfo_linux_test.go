@@ -0,0 +1,41 @@
+//go:build linux
+
+package tftp
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+/* controlMessage builds the control message the kernel passes along with a received packet */
+func controlMessage(level int32, typ int32, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = level
+	h.Type = typ
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+func TestPacketDestination(t *testing.T) {
+
+	/* A broadcast request to 10.0.0.255 that arrived on the interface with address 10.0.0.1 */
+
+	pktinfo := []byte{2, 0, 0, 0, 10, 0, 0, 1, 10, 0, 0, 255}
+	addr := packetDestination(controlMessage(syscall.IPPROTO_IP, syscall.IP_PKTINFO, pktinfo))
+	if addr == nil || !addr.IP.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("IPv4 destination is %v, want 10.0.0.1", addr)
+	}
+
+	pktinfo6 := append(net.ParseIP("ff02::1").To16(), 2, 0, 0, 0)
+	if addr := packetDestination(controlMessage(syscall.IPPROTO_IPV6, syscall.IPV6_PKTINFO, pktinfo6)); addr != nil {
+		t.Errorf("IPv6 multicast destination is %v, want none", addr)
+	}
+	pktinfo6 = append(net.ParseIP("fd00::2").To16(), 2, 0, 0, 0)
+	if addr := packetDestination(controlMessage(syscall.IPPROTO_IPV6, syscall.IPV6_PKTINFO, pktinfo6)); addr == nil || addr.String() != "[fd00::2]:0" {
+		t.Errorf("IPv6 destination is %v, want fd00::2", addr)
+	}
+}
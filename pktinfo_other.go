@@ -0,0 +1,16 @@
+//go:build !linux
+
+/* This file contains the fallback for systems without IP_PKTINFO support. */
+/* A server listening on all addresses sends replies from the address picked by the routing table */
+
+package tftp
+
+import "net"
+
+const packetInfoSize = 0
+
+func enablePacketInfo(conn *net.UDPConn) {}
+
+func packetDestination(oob []byte) *net.UDPAddr {
+	return nil
+}
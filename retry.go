@@ -0,0 +1,86 @@
+/* This file contains the retry policy that decides how long a transfer waits for the peer and how often it retransmits */
+
+package tftp
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+/* ErrDeadline is returned when a transfer does not complete within RetryPolicy.Deadline */
+var ErrDeadline = errors.New("tftp: transfer deadline exceeded")
+
+/* RetryPolicy controls retransmission when the peer does not answer. The zero value retransmits a packet */
+/* 3 times, every time the timeout expires, with no limit on the duration of the whole transfer */
+type RetryPolicy struct {
+	Retries    int           /* Retransmissions of a packet before the transfer gives up, 3 if zero, none if negative */
+	Backoff    float64       /* Factor the timeout is multiplied by after each retransmission, no backoff if 1 or less */
+	MaxTimeout time.Duration /* Largest timeout reached by backoff, no limit if zero */
+	Jitter     float64       /* Every timeout is varied randomly by upto this fraction of it, 0.1 for 10% */
+	Deadline   time.Duration /* Longest a whole transfer may take, no limit if zero */
+
+	/* If set, the sender derives the timeout from the round trips it measures, starting from the configured timeout */
+	/* The result stays between MinTimeout, 10 milliseconds if zero, and MaxTimeout, the configured timeout if zero */
+	Adaptive   bool
+	MinTimeout time.Duration
+}
+
+/* retries returns the number of retransmissions of a packet */
+func (p *RetryPolicy) retries() int {
+	if p.Retries == 0 {
+		return senderRetries - 1
+	}
+	if p.Retries < 0 {
+		return 0
+	}
+	return p.Retries
+}
+
+/* timeout returns how long to wait for an answer after the given number of retransmissions of a packet */
+func (p *RetryPolicy) timeout(base time.Duration, retransmissions int, jitter bool) time.Duration {
+	d := float64(base)
+	if p.Backoff > 1 {
+		d *= math.Pow(p.Backoff, float64(retransmissions))
+	}
+	if p.MaxTimeout > 0 && d > float64(p.MaxTimeout) {
+		d = float64(p.MaxTimeout)
+	}
+	/* The timeout stays backed off across packets until a round trip is measured, so it may grow large */
+	if d > float64(math.MaxInt64/2) {
+		d = float64(math.MaxInt64 / 2)
+	}
+	if jitter && p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+/* adaptiveBounds returns the range of an adaptive timeout when base is the configured timeout */
+func (p *RetryPolicy) adaptiveBounds(base time.Duration) (time.Duration, time.Duration) {
+	min, max := p.MinTimeout, p.MaxTimeout
+	if min <= 0 {
+		min = minAdaptiveTimeout
+	}
+	if max <= 0 {
+		max = base
+	}
+	if min > max {
+		min = max
+	}
+	return min, max
+}
+
+/* patience returns how long a receiver waits for the next packet, the time a sender with the same */
+/* policy takes to go through all the retransmissions of a packet */
+func (p *RetryPolicy) patience(base time.Duration) time.Duration {
+	if p.Adaptive {
+		_, base = p.adaptiveBounds(base)
+	}
+	var total time.Duration
+	for i := 0; i <= p.retries(); i++ {
+		total += p.timeout(base, i, false)
+	}
+	return total
+}
@@ -0,0 +1,141 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyTimeout(t *testing.T) {
+	tests := []struct {
+		policy   RetryPolicy
+		retries  int
+		timeouts []time.Duration
+		patience time.Duration
+	}{
+		{RetryPolicy{}, 3, []time.Duration{time.Second, time.Second, time.Second, time.Second}, 4 * time.Second},
+		{RetryPolicy{Retries: -1}, 0, []time.Duration{time.Second}, time.Second},
+		{RetryPolicy{Retries: 2, Backoff: 2}, 2, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}, 7 * time.Second},
+		{RetryPolicy{Retries: 3, Backoff: 3, MaxTimeout: 5 * time.Second}, 3, []time.Duration{time.Second, 3 * time.Second, 5 * time.Second, 5 * time.Second}, 14 * time.Second},
+	}
+	for _, test := range tests {
+		if got := test.policy.retries(); got != test.retries {
+			t.Errorf("%+v: %d retries, want %d", test.policy, got, test.retries)
+		}
+		for i, want := range test.timeouts {
+			if got := test.policy.timeout(time.Second, i, false); got != want {
+				t.Errorf("%+v: timeout after %d retransmissions is %v, want %v", test.policy, i, got, want)
+			}
+		}
+		if got := test.policy.patience(time.Second); got != test.patience {
+			t.Errorf("%+v: patience is %v, want %v", test.policy, got, test.patience)
+		}
+	}
+
+	jittered := RetryPolicy{Jitter: 0.1}
+	for i := 0; i < 100; i++ {
+		if got := jittered.timeout(time.Second, 0, true); got < 900*time.Millisecond || got > 1100*time.Millisecond {
+			t.Fatalf("timeout with 10%% jitter is %v", got)
+		}
+	}
+}
+
+/* silentServer counts the requests it receives and never answers them */
+func silentServer(t *testing.T) (*net.UDPAddr, *atomic.Int32) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var requests atomic.Int32
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n >= 2 && (buf[1] == 1 || buf[1] == 2) {
+				requests.Add(1)
+			}
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr), &requests
+}
+
+/* TestRequestRetries checks how often and how long the client asks a server that never answers */
+func TestRequestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		retry    RetryPolicy
+		err      error
+		requests int32
+		min, max time.Duration
+	}{
+		{"NoRetries", RetryPolicy{Retries: -1}, ErrTimeout, 1, 100 * time.Millisecond, 300 * time.Millisecond},
+		{"Backoff", RetryPolicy{Retries: 2, Backoff: 2}, ErrTimeout, 3, 700 * time.Millisecond, 1100 * time.Millisecond},
+		{"Deadline", RetryPolicy{Retries: 100, Deadline: 350 * time.Millisecond}, ErrDeadline, 4, 350 * time.Millisecond, 600 * time.Millisecond},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			addr, requests := silentServer(t)
+			c := &Client{Addr: addr.String(), Timeout: 100 * time.Millisecond, Retry: test.retry}
+			start := time.Now()
+			err := c.Get("file", filepath.Join(t.TempDir(), "file"))
+			elapsed := time.Since(start)
+			if !errors.Is(err, test.err) {
+				t.Errorf("Get returned %v, want %v", err, test.err)
+			}
+			if elapsed < test.min || elapsed > test.max {
+				t.Errorf("Get gave up after %v, want between %v and %v", elapsed, test.min, test.max)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if got := requests.Load(); got != test.requests {
+				t.Errorf("server received %d requests, want %d", got, test.requests)
+			}
+		})
+	}
+}
+
+/* TestServerDeadline checks that the server gives up on a client that stops answering once */
+/* the deadline has passed and tells it so, however many retransmissions are left */
+func TestServerDeadline(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.Store("file", bytes.Repeat([]byte{0xA5}, 2000))
+	addr := newTestServer(t, &Server{Backend: backend, Timeout: 100 * time.Millisecond, Retry: RetryPolicy{Retries: 100, Deadline: 350 * time.Millisecond}})
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if _, err := conn.WriteToUDP([]byte("\x00\x01file\x00octet\x00"), addr); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.HasPrefix(buf[:n], []byte("\x00\x03\x00\x01")) {
+			continue
+		}
+		if want := "\x00\x05\x00\x00transfer deadline exceeded\x00"; string(buf[:n]) != want {
+			t.Fatalf("received %q, want %q", buf[:n], want)
+		}
+		break
+	}
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond || elapsed > 600*time.Millisecond {
+		t.Errorf("server gave up after %v", elapsed)
+	}
+}
@@ -0,0 +1,53 @@
+/* This file contains the round trip time estimator that adapts the retransmission timeout to the link (RFC 6298) */
+
+package tftp
+
+import "time"
+
+/* Smallest adaptive timeout unless RetryPolicy.MinTimeout says otherwise */
+const minAdaptiveTimeout = 10 * time.Millisecond
+
+/* Clock granularity, the least that is added to the smoothed round trip time for its variation */
+const rttGranularity = time.Millisecond
+
+/* rttEstimator keeps the smoothed round trip time of a transfer and its variation (Jacobson/Karels) */
+type rttEstimator struct {
+	srtt    time.Duration
+	rttvar  time.Duration
+	sampled bool /* false until the first round trip is measured */
+}
+
+/* sample adds a measured round trip. Round trips of retransmitted packets are ambiguous and must not be sampled (Karn) */
+func (e *rttEstimator) sample(rtt time.Duration) {
+	if !e.sampled {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.sampled = true
+		return
+	}
+	diff := e.srtt - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	e.rttvar = (3*e.rttvar + diff) / 4
+	e.srtt = (7*e.srtt + rtt) / 8
+}
+
+/* timeout returns the retransmission timeout within min and max, initial until a round trip is measured */
+func (e *rttEstimator) timeout(initial time.Duration, min time.Duration, max time.Duration) time.Duration {
+	if !e.sampled {
+		return initial
+	}
+	variation := 4 * e.rttvar
+	if variation < rttGranularity {
+		variation = rttGranularity
+	}
+	rto := e.srtt + variation
+	if rto < min {
+		rto = min
+	}
+	if rto > max {
+		rto = max
+	}
+	return rto
+}
@@ -1,287 +1,482 @@
-package main
+package tftp
+
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
-	"os"
-	"strconv"
-	"bytes"
+	"runtime/debug"
+	"sync"
 	"time"
 )
-func main() {
 
-	service := "127.0.0.1:1201"
+/* ErrServerClosed is returned by Serve and ListenAndServe after a call to Close */
+var ErrServerClosed = errors.New("tftp: server closed")
+
+/* Server is a TFTP server. Every read or write request is handled in its own goroutine */
+type Server struct {
+	Addr         string        /* UDP address to listen on, "127.0.0.1:1201" if empty. ":69" listens on all IPv4 and IPv6 addresses on the standard port */
+	Interface    string        /* If set, the server listens on the address of this network interface and the port of Addr. An IPv6 Addr such as "[::]:69" selects an IPv6 address */
+	Root         string        /* Directory served to clients if Backend is nil, the current directory if empty */
+	Backend      Backend       /* Files served to clients, DirBackend(Root) if nil */
+	ReadHandler  ReadHandler   /* Serves read requests, with the files of Backend if nil */
+	WriteHandler WriteHandler  /* Serves write requests, with the files of Backend if nil */
+	Timeout      time.Duration /* Retransmission timeout unless the client negotiates one, 5 seconds if zero */
+	MaxFileSize  int64         /* Largest file accepted by a write request, no limit if zero */
+	Rollover     uint16        /* Block number that follows block 65535 unless the client negotiates one, 0 or 1 */
+	Retry        RetryPolicy   /* Retransmissions, backoff and overall deadline of a transfer */
+	Logger       *log.Logger   /* Progress and error messages are discarded if nil */
+
+	mu             sync.Mutex
+	controlChannel *net.UDPConn
+	dataChannels   map[*net.UDPConn]struct{} /* Data channels of the transfers in progress */
+	transfers      sync.WaitGroup
+	closed         bool
+}
+
+/* NewServer returns a Server that will listen on addr */
+func NewServer(addr string) *Server {
+	return &Server{Addr: addr}
+}
+
+/* ListenAndServe opens the control channel on s.Addr and serves requests until Close is called */
+func (s *Server) ListenAndServe() error {
+	service := s.Addr
+	if service == "" {
+		service = "127.0.0.1:1201"
+	}
 	udpAddr, err := net.ResolveUDPAddr("udp", service)
 	if err != nil {
-		fmt.Println(os.Stderr, "Error occurred: ", err.Error())
-		os.Exit(0)
-	} 
+		return err
+	}
+	if s.Interface != "" {
+		ipv6 := udpAddr.IP != nil && udpAddr.IP.To4() == nil
+		udpAddr.IP, udpAddr.Zone, err = interfaceAddr(s.Interface, ipv6)
+		if err != nil {
+			return err
+		}
+	}
 
 	/* Server Control Channel */
-	
+
 	controlChannel, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
-		fmt.Println(os.Stderr, "Error occurred: ", err.Error())
-		os.Exit(0)
-	} 
+		return err
+	}
+	return s.Serve(controlChannel)
+}
+
+/* interfaceAddr returns an address of a network interface. If ipv6 is set it picks an IPv6 address, */
+/* preferring global ones over link-local ones which are returned with the interface as their zone. */
+/* Otherwise it picks an IPv4 address */
+func interfaceAddr(name string, ipv6 bool) (net.IP, string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, "", err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, "", err
+	}
+	var linkLocal net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() == nil) != ipv6 {
+			continue
+		}
+		if ipv6 && ipNet.IP.IsLinkLocalUnicast() {
+			if linkLocal == nil {
+				linkLocal = ipNet.IP
+			}
+			continue
+		}
+		return ipNet.IP, "", nil
+	}
+	if linkLocal != nil {
+		return linkLocal, iface.Name, nil
+	}
+	return nil, "", fmt.Errorf("tftp: interface %s has no suitable address", name)
+}
+
+/* Serve accepts requests on the control channel until Close is called */
+func (s *Server) Serve(controlChannel *net.UDPConn) error {
+	if err := checkRollover(s.Rollover); err != nil {
+		controlChannel.Close()
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		controlChannel.Close()
+		return ErrServerClosed
+	}
+	s.controlChannel = controlChannel
+	enablePacketInfo(controlChannel)
+	s.mu.Unlock()
+
 	for {
-		handleClient(controlChannel)
+		err := s.handleClient(controlChannel)
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				continue
+			}
+			return err
+		}
+	}
+}
+
+/* Close stops the server from accepting new requests and aborts the transfers in progress. */
+/* It returns once every transfer has ended, so uploads that did not complete have been discarded */
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.controlChannel != nil {
+		err = s.controlChannel.Close()
 	}
+	for dataChannel := range s.dataChannels {
+		dataChannel.Close()
+	}
+	s.mu.Unlock()
+	s.transfers.Wait()
+	return err
 }
-func handleClient(controlChannel *net.UDPConn) {
 
-    var buf [516]byte
-    _, clientAddr, err := controlChannel.ReadFromUDP(buf[0:])            
+/* trackTransfer registers the data channel of a new transfer so that Close can abort it. */
+/* It returns false if the server is already closed and the transfer must not start */
+func (s *Server) trackTransfer(dataChannel *net.UDPConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.dataChannels == nil {
+		s.dataChannels = make(map[*net.UDPConn]struct{})
+	}
+	s.dataChannels[dataChannel] = struct{}{}
+	s.transfers.Add(1)
+	return true
+}
+
+func (s *Server) untrackTransfer(dataChannel *net.UDPConn) {
+	s.mu.Lock()
+	delete(s.dataChannels, dataChannel)
+	s.mu.Unlock()
+	s.transfers.Done()
+}
+
+/* backend returns the Backend that serves the files of the transfers */
+func (s *Server) backend() Backend {
+	if s.Backend != nil {
+		return s.Backend
+	}
+	return DirBackend(s.Root)
+}
+
+func (s *Server) readHandler() ReadHandler {
+	if s.ReadHandler != nil {
+		return s.ReadHandler
+	}
+	return backendHandler{backend: s.backend()}
+}
+
+func (s *Server) writeHandler() WriteHandler {
+	if s.WriteHandler != nil {
+		return s.WriteHandler
+	}
+	return backendHandler{backend: s.backend()}
+}
+
+/* newTransferOptions returns the values used for a transfer before the client's options are applied */
+func (s *Server) newTransferOptions(read bool) *transferOptions {
+	opts := newTransferOptions(read)
+	if s.Timeout > 0 {
+		opts.timeout = s.Timeout
+	}
+	opts.maxTransferSize = s.MaxFileSize
+	opts.rollover = s.Rollover
+	opts.retry = s.Retry
+	return opts
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+func (s *Server) handleClient(controlChannel *net.UDPConn) error {
+
+	buf := make([]byte, maxPacketSize)
+	oob := make([]byte, packetInfoSize)
+	n, oobn, _, clientAddr, err := controlChannel.ReadMsgUDP(buf, oob)
 	if err != nil {
-		return
+		return err
 	}
-    /* When a request comes from a client, a separate thread is created using goroutine */
-    /* Allows multiple clients to concurrently send requests to the server in the control channel */	
-	
-	go handleClientUtil(controlChannel, clientAddr, buf)
+	/* When a request comes from a client, a separate thread is created using goroutine */
+	/* Allows multiple clients to concurrently send requests to the server in the control channel */
+
+	go s.handleClientUtil(controlChannel, clientAddr, packetDestination(oob[:oobn]), buf[:n])
+	return nil
 }
 
-/* Goroutine for each client request */ 
+/* Goroutine for each client request. localAddr is the address the request was sent to, nil if it is not known */
+
+func (s *Server) handleClientUtil(controlChannel *net.UDPConn, clientAddr *net.UDPAddr, localAddr *net.UDPAddr, buf []byte) {
+
+	/* A panic while serving one request, in the server or in a handler, ends that transfer only */
+
+	defer func() {
+		if r := recover(); r != nil {
+			s.logf("Recovered from panic while serving %s: %v\n%s", clientAddr, r, debug.Stack())
+		}
+	}()
+
+	/* Server discards any packets with opcode other than RRQ (1) and WRQ (2) in the control channel */
+
+	if len(buf) < 2 {
+		return
+	}
+	opcode := binary.BigEndian.Uint16(buf)
+	if opcode != opRRQ && opcode != opWRQ {
+		return
+	}
+
+	/* Malformed requests are rejected with an Illegal TFTP operation error */
+
+	request, err := parsePacket(buf)
+	if err != nil {
+		s.logf("Rejecting request from %s: %v", clientAddr, err)
+		s.rejectRequest(controlChannel, clientAddr, err)
+		return
+	}
+	var fileName, mode string
+	var options map[string]string
+	switch r := request.(type) {
+	case *ReadRequest:
+		fileName, mode, options = r.Filename, r.Mode, r.Options
+	case *WriteRequest:
+		fileName, mode, options = r.Filename, r.Mode, r.Options
+	}
+	if mode == modeMail {
+		s.logf("Rejecting request from %s: mail mode is not supported", clientAddr)
+		s.rejectRequest(controlChannel, clientAddr, errors.New("mail mode is not supported"))
+		return
+	}
+	/* Creating Data Channel on a new random server port, which is the server's transfer ID (RFC 1350) */
+	/* Replies are sent from the address the request arrived on, so that a client on a multi-homed server */
+	/* hears back from the address it talked to. Without packet info that is the address of the control channel */
 
-func handleClientUtil(controlChannel *net.UDPConn, clientAddr *net.UDPAddr, buf [516]byte) {
+	if controlAddr, ok := controlChannel.LocalAddr().(*net.UDPAddr); ok && !controlAddr.IP.IsUnspecified() {
+		localAddr = &net.UDPAddr{IP: controlAddr.IP, Zone: controlAddr.Zone}
+	} else if localAddr == nil {
+		localAddr = &net.UDPAddr{}
+	}
+	dataChannel, err := net.ListenUDP("udp", localAddr)
+	if err != nil && !localAddr.IP.IsUnspecified() {
 
-    bufByte := convertDataIngressBufType(buf)
-    opcode := getOpcode(bufByte)
-	
-	/* Server discards any packets with opcode other than RRQ (1) and WRQ (2) in the control channel */ 
+		/* If the address cannot be bound, the routing table picks the address to reply from */
 
-	if opcode != 1 && opcode != 2 {
-	    return
+		s.logf("Cannot open data channel at %s, using any address: %v", localAddr, err)
+		dataChannel, err = net.ListenUDP("udp", &net.UDPAddr{})
 	}
-	clientPort := strconv.Itoa(clientAddr.Port)
-    newService := "127.0.0.1:"+clientPort
-    newudpAddr, err := net.ResolveUDPAddr("udp", newService)
-    if err != nil {
-		fmt.Fprintf(os.Stderr, "Error occurred during client transaction: ", err.Error())
+	if err != nil {
+		s.logf("Error occurred during client transaction: %v", err)
+		sendPacket(controlChannel, clientAddr, errorPacket(err))
 		return
-	} 
-	
-	/* Creating Data Channel with a random server port and same client port */
-    
-	dataChannel, err := net.DialUDP("udp", nil, newudpAddr)
-    if err != nil {
-		fmt.Fprintf(os.Stderr, "Error occurred during client transaction: ", err.Error())
+	}
+	s.logf("New data channel opened at %s for %s", dataChannel.LocalAddr(), clientAddr)
+	if !s.trackTransfer(dataChannel) {
+		dataChannel.Close()
 		return
-	} 
-    fmt.Println("New data channel opened at :", newService)	
-	fileName := getFileName(bufByte)
-	if opcode == 1 {
-	    handleClientReadRequest(dataChannel, fileName)
+	}
+	defer s.untrackTransfer(dataChannel)
+	req := &Request{Filename: fileName, Addr: clientAddr, Mode: mode, Options: options}
+	if _, ok := request.(*ReadRequest); ok {
+		s.handleClientReadRequest(dataChannel, req)
 	} else {
-	    handleClientWriteRequest(dataChannel, fileName)
+		s.handleClientWriteRequest(dataChannel, req)
+	}
+}
+
+/* rejectRequest answers a request that will not be served with an Illegal TFTP operation error */
+func (s *Server) rejectRequest(controlChannel *net.UDPConn, clientAddr *net.UDPAddr, reason error) {
+	err := sendPacket(controlChannel, clientAddr, illegalOperation(reason))
+	if err != nil {
+		s.logf("Error occurred during client transaction: %v", err)
 	}
 }
 
 /* Handler for processing Read requests from the client */
 
-func handleClientReadRequest(dataChannel *net.UDPConn, fileName string) {
-	
-	fmt.Println("Handling client read request.")
-	var ingressBuf [4]byte
-	var expectedBlockNum uint16 = 0
-	var lastPacket bool = false
-	var retryCount int = 1
-	var closeConn bool = false
-	prevDataPacket := make([]byte, 512)
-	
-    dataChannel.SetReadDeadline(time.Now().Add(time.Second * 10))
-	fileRead, err := os.Open(fileName) 
-    if err != nil {
-	    fmt.Fprintf(os.Stderr, "Error occurred during client transaction: ", err.Error())
-	    dataChannel.Close()
-        return
-	} 
-	for {
-	    inputBuf := make([]byte, 512)
-        inputBufSize, err := fileRead.Read(inputBuf)
-		/* Send error packet if file read fails */
-		if err != nil {
-		    errorPacket := constructErrorPacket(5)
-			_, errToClient := dataChannel.Write(errorPacket)
-			if errToClient != nil {
-			    fmt.Fprintf(os.Stderr, "Error occurred during client transaction: ", errToClient.Error())
-			    break
-			}
-		    fmt.Fprintf(os.Stderr, "Error occurred during client transaction: ", err.Error())
-		    break
-	    } 
-		
-		/* expectedBlockNum is the block number of the data packet that is being sent from the server */
-		/* It is the block number that is expected to be Acknowledged by the client */
-		
-		expectedBlockNum = expectedBlockNum+1
-		dataPacket := constructDataPacket(expectedBlockNum, inputBuf, inputBufSize)
-		_, errWrite := dataChannel.Write(dataPacket)
-        if errWrite != nil {
-		    fmt.Fprintf(os.Stderr, "Error occurred during client transaction: ", errWrite.Error())
-		    break
-	    } 
-		fmt.Println("Sent data block num: ", expectedBlockNum)
-		
-		/* If data packet is less than 516 bytes, it is the last packet */
-		
-		if len(dataPacket) < 516 {
-		   lastPacket = true
-		}
-		prevDataPacket = make([]byte, len(dataPacket))
-		prevDataPacket = dataPacket
-		
-		/* Previous data packet is retransmitted upto 4 times after read timeout for Ack for client */ 
-	    for { 
-	        _, _, err := dataChannel.ReadFromUDP(ingressBuf[0:])
-		    if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				if retryCount == 4 {
-				    fmt.Println("Client timed out. Closing client connection. Try again.")
-				    closeConn = true
-					break
-				}
-				_, errWr := dataChannel.Write(prevDataPacket)
-                if errWr != nil {
-		            fmt.Fprintf(os.Stderr, "Error occurred during client transaction: ", errWr.Error())
-		            closeConn = true
-					break
-	            } 
-				fmt.Println("Sent block num: ", expectedBlockNum)
-				retryCount += 1
-			} else {
-			    ingressByte := convertAckIngressBufType(ingressBuf)
-		        opcode := getOpcode(ingressByte)
-		        
-				/* Allow only Ack packets from client on data channel for read request */ 
-				if opcode != 4 {
-		            closeConn = true
-					break
-		        }
-		        blockNum := getBlockNum(ingressByte)
-		        fmt.Println("Received Ack for block: ", blockNum)
-				
-				/* In TFTP, Data block is sent only after Ack is received for prev packet */
-				/* So, Ack for any block other than the expected block is not allowed */
-				
-                if blockNum != expectedBlockNum {
-				    closeConn = true
-					break
-				} else {         /* If correct Ack is received */
-				    if lastPacket == true {     /* If that Ack is for the last packet, close the client connection successfully */ 
-					    fmt.Println("Client has fully read the file from the server.")
-						closeConn = true
-						break
-					} else {     /* If it is not last packet, go back to the top and send another data packet */
-					    break
-					}				    
-				}
-			}
+func (s *Server) handleClientReadRequest(dataChannel *net.UDPConn, req *Request) {
+
+	s.logf("Handling client read request.")
+	defer dataChannel.Close()
+
+	/* Every option but tsize is negotiated before the handler is called, so that it sees them in req.Negotiated. */
+	/* The answer to tsize depends on the file the handler returns, so it is negotiated afterwards */
+
+	opts := s.newTransferOptions(true)
+	options := make(map[string]string, len(req.Options))
+	for name, value := range req.Options {
+		if name != "tsize" {
+			options[name] = value
 		}
-		if closeConn == true {
-		    break
+	}
+	oack, err := negotiateOptions(options, opts)
+	if err != nil {
+		s.logf("Error occurred during client transaction: %v", err)
+		sendPacket(dataChannel, req.Addr, errorPacket(err))
+		return
+	}
+	req.Negotiated = negotiatedOptions(oack)
+
+	fileRead, err := s.readHandler().ServeRead(req)
+	if err != nil {
+		s.logf("Error occurred during client transaction: %v", err)
+		sendPacket(dataChannel, req.Addr, errorPacket(err))
+		return
+	}
+	if closer, ok := fileRead.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	/* The size of a netascii transfer is not known until the file is translated, so tsize is only answered in octet mode */
+
+	var r io.Reader = fileRead
+	if req.Mode == modeNetascii {
+		r = newNetasciiReader(fileRead)
+	} else {
+		opts.transferSize = readerSize(fileRead)
+	}
+	if value, ok := req.Options["tsize"]; ok {
+		sizeAck, err := negotiateOptions(map[string]string{"tsize": value}, opts)
+		if err != nil {
+			s.logf("Error occurred during client transaction: %v", err)
+			sendPacket(dataChannel, req.Addr, errorPacket(err))
+			return
 		}
-	}	
-	fileRead.Close()
-	dataChannel.Close()
-    return
+		oack = mergeOptionAcks(oack, sizeAck)
+	}
+
+	/* If any option is accepted, the transfer starts with an OACK that the client acknowledges with Ack 0 */
+	/* Otherwise the first data block is sent right away */
+
+	var start packet
+	if oack != nil {
+		start = oack
+		s.logf("Sending option acknowledgment.")
+	}
+	err = newTransfer(dataChannel, req.Addr, opts, s.logf).sendData(r, start)
+	if err != nil {
+		s.logf("Data transfer did not succeed: %v", err)
+		return
+	}
+	s.logf("Client has fully read the file from the server.")
 }
 
 /* Handler for processing write requests from the client */
 
-func handleClientWriteRequest(dataChannel *net.UDPConn, fileName string) {
-
-    fmt.Println("Handling client write request.")
-	var ingressBuf [516]byte
-    var ingressBufSize int
-    var clientDataBuf bytes.Buffer
-	var prevBlockNum uint16 = 0
-    var blockNum uint16 = 0
-	var lastPacket bool = false
-	dataChannel.SetReadDeadline(time.Now().Add(time.Second * 18))
-    
+func (s *Server) handleClientWriteRequest(dataChannel *net.UDPConn, req *Request) {
+
+	s.logf("Handling client write request.")
+	defer dataChannel.Close()
+
+	/* Options are negotiated first, so that a file announced as too large (tsize) is refused before anything is created */
+
+	opts := s.newTransferOptions(false)
+	oack, err := negotiateOptions(req.Options, opts)
+	if err != nil {
+		s.logf("Error occurred during client transaction: %v", err)
+		sendPacket(dataChannel, req.Addr, errorPacket(err))
+		return
+	}
+	req.Negotiated = negotiatedOptions(oack)
+
+	/* The upload is created before the transfer starts so that the client learns right away if the file cannot be written */
+	/* It is committed only once the whole file has been received */
+
+	fileWrite, err := s.writeHandler().ServeWrite(req)
+	if err != nil {
+		s.logf("Error occurred during client transaction: %v", err)
+		sendPacket(dataChannel, req.Addr, errorPacket(err))
+		return
+	}
+
+	/* If the handler or the upload panics, the upload is aborted before the panic reaches handleClientUtil, */
+	/* so that no staged file is left behind, and the client is told the transfer failed */
+
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("tftp: panic while receiving %s: %v", req.Filename, r)
+			finishWrite(fileWrite, err)
+			sendPacket(dataChannel, req.Addr, errorPacket(err))
+			panic(r)
+		}
+	}()
+
 	/* Send Ack for block 0 to start data transfer from the client */
-	
-	ackBuf := constructAckPacket(4, 0)
-	_, errAck := dataChannel.Write(ackBuf)
-    if errAck != nil {
-	    fmt.Fprintf(os.Stderr, "Error occurred during client transaction: ", errAck.Error())
-		dataChannel.Close()
+	/* If any option is accepted, an OACK is sent in place of Ack 0 */
+	/* It is retransmitted until the first data block arrives */
+
+	var startPacket packet = &Ack{Block: 0}
+	if oack != nil {
+		startPacket = oack
+	}
+	errAck := sendPacket(dataChannel, req.Addr, startPacket)
+	if errAck != nil {
+		s.logf("Error occurred during client transaction: %v", errAck)
+		finishWrite(fileWrite, errAck)
 		return
 	}
-	fmt.Println("Ack sent for block 0")
-	
-	/* Ack is not retransmitted. If Ack gets lost, the client will retransmit the previous data packet again */
-	
-	for {
-	        /* If last data block is received and Ack is sent by the server but not received by the client, */
-			/* Client will retransmit the last data block again. So, wait for a few seconds before closing connection. */
-			
-		    if lastPacket == true {
-			   dataChannel.SetReadDeadline(time.Now().Add(time.Second * 5))
-			   _, _, err := dataChannel.ReadFromUDP(ingressBuf[0:])
-			   if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				   fileWrite, err := os.Create(fileName)
-	               if err != nil {
-		               fmt.Fprintf(os.Stderr, "Error occurred during client transaction: ", err.Error())
-					   break
-	               } 
-		           _, errOutput := fileWrite.WriteString(clientDataBuf.String())
-	               if errOutput != nil {
-		               fmt.Fprintf(os.Stderr, "Error occurred during client transaction: ", errOutput.Error())
-					   fileWrite.Close()
-					   break
-	               } 
-		           fileWrite.Close()
-				   fmt.Println("File has been successfully written by the server into the current directory.")
-				   break
-			   }
-			} else {   
-	               ingressBufferSize, _, err := dataChannel.ReadFromUDP(ingressBuf[0:])
-				   ingressBufSize = ingressBufferSize
-			       if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-			           fmt.Println("Client timed out. Closing client connection. Try again.")
-				       break
-			       }
-			}
-			ingressByte := convertDataIngressBufType(ingressBuf)
-			opcode := getOpcode(ingressByte)
-			
-			/* Received error packet from client */ 				
-			if opcode == 5 {
-			   fmt.Println("Data transfer did not succeed. Closing client connection. Try again.")
-			   break
-			}
-			blockNum = getBlockNum(ingressByte)
-			fmt.Println("Received Data Block ", blockNum)
-			
-			/* Storing only unique data blocks in the buffer */ 
-			/* If Data is received and stored but if Ack did not reach the client, */
-			/* data will be resent from client. In this case, no need to store it in the buffer again. */
-			
-			if prevBlockNum < blockNum {                   
-                ingressDataBuf := getIngressData(ingressByte, ingressBufSize)
-                clientDataBuf.Grow(len(ingressDataBuf)) 			
-	            _, errBufWr := clientDataBuf.Write(ingressDataBuf)
-	            if errBufWr != nil {
-		               fmt.Fprintf(os.Stderr, "Error occurred during client transaction: ", errBufWr.Error())
-					   break
-	            } 
-			}
-			
-			/* If Ack from server did not reach the client, client wil timeout and send prev data packet again. */
-            /* So send the Ack for the prev data block again to ensure that client will move onto the next data packet */
-			
-			prevBlockNum = blockNum
-			ackBuf := constructAckPacket(4, prevBlockNum)
-			_, errWr := dataChannel.Write(ackBuf)
-            if errWr != nil {
-		        fmt.Fprintf(os.Stderr, "Error occurred during client transaction: ", errWr.Error())
-		    	break
-	        } 
-			fmt.Println("Ack sent for block ",prevBlockNum)
-			if ingressBufSize < 516 {
-			    lastPacket = true
-			}
-	    }
-		dataChannel.Close()
+	if oack != nil {
+		s.logf("Sent option acknowledgment.")
+	} else {
+		s.logf("Ack sent for block 0")
+	}
+
+	/* Blocks are written to the file as they arrive, so only the current block is held in memory */
+	/* A transfer that times out, is aborted by an ERROR packet or by Close leaves no file behind */
+
+	var w io.Writer = fileWrite
+	if opts.maxTransferSize > 0 {
+		w = &limitedWriter{w: w, remaining: opts.maxTransferSize}
+	}
+	var netascii *netasciiWriter
+	if req.Mode == modeNetascii {
+		netascii = newNetasciiWriter(w)
+		w = netascii
+	}
+	t := newTransfer(dataChannel, req.Addr, opts, s.logf)
+	first, err := t.waitForData(startPacket)
+	if err == nil {
+		err = t.receiveData(w, first)
+	}
+	if err == nil && netascii != nil {
+		err = netascii.Close()
+	}
+	if err != nil {
+		s.logf("Data transfer did not succeed: %v", err)
+		finishWrite(fileWrite, err)
 		return
+	}
+	err = finishWrite(fileWrite, nil)
+	if err != nil {
+		s.logf("Error occurred during client transaction: %v", err)
+		return
+	}
+	s.logf("File has been successfully written by the server into the current directory.")
+
+	/* The file is committed as soon as the last block is acknowledged, so the client can read it back right away */
+
+	t.dally()
 }
@@ -0,0 +1,409 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	stdlog "log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, s *Server) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Timeout == 0 {
+		s.Timeout = time.Second
+	}
+	go s.Serve(conn)
+	t.Cleanup(func() { s.Close() })
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+/* chdirTemp moves the test into an empty directory, which is what the server serves */
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func TestGetAndPut(t *testing.T) {
+	dir := chdirTemp(t)
+	addr := newTestServer(t, &Server{})
+	want := bytes.Repeat([]byte("0123456789"), 300)
+	if err := os.WriteFile(filepath.Join(dir, "local"), want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{Addr: addr.String(), Timeout: time.Second, Options: map[string]string{"windowsize": "4"}}
+	t.Run("Get", func(t *testing.T) {
+		t.Parallel()
+		if err := c.Get("local", "copy"); err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, "copy"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes, want %d", len(got), len(want))
+		}
+	})
+	t.Run("Put", func(t *testing.T) {
+		t.Parallel()
+		if err := c.Put("local", "remote"); err != nil {
+			t.Fatal(err)
+		}
+		/* The server stores the upload once it stops waiting for a retransmitted last block */
+		deadline := time.Now().Add(15 * time.Second)
+		for {
+			got, _ := os.ReadFile(filepath.Join(dir, "remote"))
+			if bytes.Equal(got, want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("stored %d bytes, want %d", len(got), len(want))
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+}
+
+/* TestLostStartPacket drops the server's Ack 0 and checks that it is sent again from the same port instead of the upload stalling */
+func TestLostStartPacket(t *testing.T) {
+	dir := chdirTemp(t)
+	addr := newTestServer(t, &Server{})
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	lost, peer := exchange(t, conn, addr, []byte("\x00\x02upload\x00octet\x00"))
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, from, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("start packet was not retransmitted: %v", err)
+	}
+	if !bytes.Equal(buf[:n], lost) || from.Port != peer.Port {
+		t.Fatalf("got %q from %v after losing %q from %v", buf[:n], from, lost, peer)
+	}
+	got, _ := exchange(t, conn, peer, []byte("\x00\x03\x00\x01hi"))
+	if want := []byte("\x00\x04\x00\x01"); !bytes.Equal(got, want) {
+		t.Fatalf("DATA 1 answered with %q", got)
+	}
+	deadline := time.Now().Add(15 * time.Second)
+	for {
+		if got, _ := os.ReadFile(filepath.Join(dir, "upload")); string(got) == "hi" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("upload was never stored")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestPutIsVisibleRightAway(t *testing.T) {
+	backend := NewMemoryBackend()
+	addr := newTestServer(t, &Server{Backend: backend, Timeout: 2 * time.Second})
+	local := filepath.Join(t.TempDir(), "local")
+	want := bytes.Repeat([]byte("0123456789"), 300)
+	if err := os.WriteFile(local, want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{Addr: addr.String()}
+	if err := c.Put(local, "remote"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for {
+		if got, ok := backend.Load("remote"); ok {
+			if !bytes.Equal(got, want) {
+				t.Fatalf("stored %d bytes, want %d", len(got), len(want))
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("upload is not visible after Put returned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/* TestStagedUploadIsHidden checks that the temporary file of an upload in progress can be neither read nor written */
+func TestStagedUploadIsHidden(t *testing.T) {
+	dir := chdirTemp(t)
+	addr := newTestServer(t, &Server{})
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, peer := exchange(t, conn, addr, []byte("\x00\x02upload\x00octet\x00"))
+	exchange(t, conn, peer, append([]byte("\x00\x03\x00\x01"), make([]byte, 512)...))
+	staged, err := filepath.Glob(filepath.Join(dir, ".upload.*.tmp"))
+	if err != nil || len(staged) != 1 {
+		t.Fatalf("found staged files %v, %v", staged, err)
+	}
+	name := filepath.Base(staged[0])
+	for _, request := range []string{"\x00\x01" + name + "\x00octet\x00", "\x00\x02" + name + "\x00octet\x00"} {
+		got, _ := exchange(t, conn, addr, []byte(request))
+		if !bytes.HasPrefix(got, []byte("\x00\x05\x00\x02")) {
+			t.Errorf("%q answered with %q, want an Access violation error", request, got)
+		}
+	}
+	conn.WriteToUDP([]byte("\x00\x05\x00\x00\x00"), peer)
+}
+
+/* listenIPv6 listens on address, skipping the test if the host has no IPv6 */
+func listenIPv6(t *testing.T, network string, address string) *net.UDPConn {
+	t.Helper()
+	udpAddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	conn, err := net.ListenUDP(network, udpAddr)
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	return conn
+}
+
+func TestGetOverIPv6(t *testing.T) {
+	backend := NewMemoryBackend()
+	want := bytes.Repeat([]byte("0123456789"), 300)
+	backend.Store("file", want)
+
+	tests := []struct {
+		name    string
+		network string
+		listen  string
+		client  string
+	}{
+		{"Loopback", "udp6", "[::1]:0", "::1"},
+		{"DualStackIPv6", "udp", "[::]:0", "::1"},
+		{"DualStackIPv4", "udp", "[::]:0", "127.0.0.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := listenIPv6(t, test.network, test.listen)
+			s := &Server{Backend: backend, Timeout: time.Second}
+			go s.Serve(conn)
+			t.Cleanup(func() { s.Close() })
+
+			port := conn.LocalAddr().(*net.UDPAddr).Port
+			c := &Client{Addr: net.JoinHostPort(test.client, strconv.Itoa(port)), Timeout: time.Second}
+			local := filepath.Join(t.TempDir(), "file")
+			if err := c.Get("file", local); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := os.ReadFile(local); err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("read %d bytes, %v, want %d", len(got), err, len(want))
+			}
+		})
+	}
+}
+
+/* TestForeignTransferID checks that a packet from a port other than the client's is answered with */
+/* Unknown transfer ID and does not disturb the transfer (RFC 1350) */
+func TestForeignTransferID(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.Store("file", bytes.Repeat([]byte{0xA5}, 600))
+	addr := newTestServer(t, &Server{Backend: backend})
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	foreign, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer foreign.Close()
+
+	got, peer := exchange(t, conn, addr, []byte("\x00\x01file\x00octet\x00"))
+	if !bytes.HasPrefix(got, []byte("\x00\x03\x00\x01")) {
+		t.Fatalf("RRQ answered with %q", got[:4])
+	}
+	if got, _ := exchange(t, foreign, peer, []byte("\x00\x04\x00\x01")); !bytes.HasPrefix(got, []byte("\x00\x05\x00\x05")) {
+		t.Fatalf("foreign Ack answered with %q, want an Unknown transfer ID error", got)
+	}
+	got, from := exchange(t, conn, peer, []byte("\x00\x04\x00\x01"))
+	if from.Port != peer.Port || !bytes.Equal(got, append([]byte("\x00\x03\x00\x02"), bytes.Repeat([]byte{0xA5}, 88)...)) {
+		t.Fatalf("Ack 1 answered with %q from %s", got, from)
+	}
+	if _, err := conn.WriteToUDP([]byte("\x00\x04\x00\x02"), peer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type panickingUpload struct {
+	Upload
+}
+
+func (p panickingUpload) Write(b []byte) (int, error) {
+	panic("write failed")
+}
+
+func TestPanicAbortsUpload(t *testing.T) {
+	root := t.TempDir()
+	backend := DirBackend(root)
+	addr := newTestServer(t, &Server{Backend: backend, WriteHandler: WriteHandlerFunc(func(r *Request) (io.Writer, error) {
+		upload, err := backend.Create(r.Filename)
+		if err != nil {
+			return nil, err
+		}
+		if r.Filename == "panic" {
+			return panickingUpload{upload}, nil
+		}
+		return upload, nil
+	})})
+	local := filepath.Join(t.TempDir(), "local")
+	if err := os.WriteFile(local, []byte("contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{Addr: addr.String(), Timeout: time.Second}
+	start := time.Now()
+	if err := c.Put(local, "panic"); err == nil {
+		t.Fatal("Put to a panicking upload succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Put to a panicking upload took %v, the client should be told right away", elapsed)
+	}
+	if err := c.Put(local, "good"); err != nil {
+		t.Fatal(err)
+	}
+
+	/* The upload is committed just after the client receives the last Ack */
+
+	var entries []os.DirEntry
+	for start := time.Now(); time.Since(start) < 500*time.Millisecond; time.Sleep(10 * time.Millisecond) {
+		var err error
+		if entries, err = os.ReadDir(root); err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 1 && entries[0].Name() == "good" {
+			return
+		}
+	}
+	for _, entry := range entries {
+		t.Errorf("%s left in the root", entry.Name())
+	}
+}
+
+/* lockedBuffer collects the log of a server whose transfers run concurrently */
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+/* FuzzHandleRequest feeds arbitrary datagrams to the control channel handler. A panic is recovered by */
+/* handleClientUtil, so the log is checked for one */
+func FuzzHandleRequest(f *testing.F) {
+	f.Add([]byte("\x00\x01f\x00octet\x00"))
+	f.Add([]byte("\x00\x01f\x00netascii\x00blksize\x008\x00windowsize\x004\x00tsize\x000\x00"))
+	f.Add([]byte("\x00\x01f\x00octet\x00rollover\x001\x00timeout\x00255\x00"))
+	f.Add([]byte("\x00\x02new\x00octet\x00tsize\x0099999999999999999999\x00"))
+	f.Add([]byte("\x00\x02../escape\x00octet\x00"))
+	f.Add([]byte("\x00\x01f\x00mail\x00"))
+	f.Add([]byte("\x00\x01f\x00octet"))
+	f.Add([]byte("\x00\x03\x00\x01data"))
+	f.Add([]byte("\x00\x04\x00\x00"))
+	f.Add([]byte{0})
+
+	backend := NewMemoryBackend()
+	backend.Store("f", bytes.Repeat([]byte("line\n"), 300))
+	log := &lockedBuffer{}
+	s := &Server{Backend: backend, Timeout: 10 * time.Millisecond, Retry: RetryPolicy{Retries: -1, Deadline: 50 * time.Millisecond}, Logger: stdlog.New(log, "", 0)}
+	control, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer control.Close()
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer client.Close()
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		s.handleClientUtil(control, client.LocalAddr().(*net.UDPAddr), nil, b)
+		if strings.Contains(log.String(), "Recovered from panic") {
+			t.Fatalf("request %q panicked:\n%s", b, log)
+		}
+	})
+}
+
+/* TestLateDuplicateData checks that a DATA block that arrives again after it was acknowledged */
+/* is answered with a single Ack for the last block received, and that the transfer goes on */
+func TestLateDuplicateData(t *testing.T) {
+	backend := NewMemoryBackend()
+	addr := newTestServer(t, &Server{Backend: backend})
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	block := bytes.Repeat([]byte{0x5A}, 512)
+	_, peer := exchange(t, conn, addr, []byte("\x00\x02file\x00octet\x00"))
+	steps := []struct {
+		data []byte
+		ack  string
+	}{
+		{append([]byte("\x00\x03\x00\x01"), block...), "\x00\x04\x00\x01"},
+		{append([]byte("\x00\x03\x00\x02"), block...), "\x00\x04\x00\x02"},
+		{append([]byte("\x00\x03\x00\x01"), block...), "\x00\x04\x00\x02"},
+	}
+	for _, step := range steps {
+		if got, _ := exchange(t, conn, peer, step.data); string(got) != step.ack {
+			t.Fatalf("DATA %q answered with %q, want %q", step.data[:4], got, step.ack)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := conn.ReadFromUDP(make([]byte, 16)); err == nil {
+		t.Fatalf("late duplicate was answered twice, then with %d bytes", n)
+	}
+	if got, _ := exchange(t, conn, peer, []byte("\x00\x03\x00\x03end")); string(got) != "\x00\x04\x00\x03" {
+		t.Fatalf("last DATA answered with %q", got)
+	}
+	for start := time.Now(); time.Since(start) < 500*time.Millisecond; time.Sleep(10 * time.Millisecond) {
+		if got, ok := backend.Load("file"); ok {
+			if want := append(append(append([]byte(nil), block...), block...), "end"...); !bytes.Equal(got, want) {
+				t.Fatalf("stored %d bytes, want %d", len(got), len(want))
+			}
+			return
+		}
+	}
+	t.Fatal("upload was not stored")
+}
@@ -0,0 +1,500 @@
+/* This file contains the data exchange that is shared by the server and the client once a transfer has started */
+/* The sending side (server read, client write) and the receiving side (server write, client read) both work in */
+/* windows of opts.windowSize blocks (RFC 7440). With the default window of 1 this is the lock step of RFC 1350 */
+
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+/* ErrTimeout is returned when the peer stops answering during a transfer */
+var ErrTimeout = errors.New("tftp: peer timed out")
+
+/* transfer is one side of a data exchange on the data channel. */
+/* The peer is identified by its transfer ID (RFC 1350), the UDP port it sends from */
+type transfer struct {
+	conn       *net.UDPConn
+	peer       *net.UDPAddr
+	peerKnown  bool /* false until the first packet from the peer tells its port, see newClientTransfer */
+	opts       *transferOptions
+	ingressBuf []byte
+	retryCount int       /* Retransmissions of the current packet */
+	deadline   time.Time /* End of the transfer as set by RetryPolicy.Deadline, zero if none */
+	rtt        rttEstimator
+	backoff    int    /* Retransmissions since the last round trip was measured, the timeout stays backed off until then (Karn) */
+	lastAck    uint16 /* Block number of the Ack that ended receiveData, sent again by dally */
+	logf       func(format string, v ...interface{})
+}
+
+/* newTransfer returns a transfer with a peer whose transfer ID is known */
+func newTransfer(conn *net.UDPConn, peer *net.UDPAddr, opts *transferOptions, logf func(format string, v ...interface{})) *transfer {
+	t := &transfer{
+		conn:      conn,
+		peer:      peer,
+		peerKnown: true,
+		opts:      opts,
+		logf:      logf,
+	}
+	if opts.retry.Deadline > 0 {
+		t.deadline = time.Now().Add(opts.retry.Deadline)
+	}
+	return t
+}
+
+/* newClientTransfer returns a transfer with a server that was sent a request at server. */
+/* The server answers from a new port, and the transfer locks onto the first port that answers from the server's IP address */
+func newClientTransfer(conn *net.UDPConn, server *net.UDPAddr, opts *transferOptions, logf func(format string, v ...interface{})) *transfer {
+	t := newTransfer(conn, server, opts, logf)
+	t.peerKnown = false
+	return t
+}
+
+/* blockNumber returns the block number sent on the wire for the n-th block of the transfer. */
+/* Block numbers are 16 bits, after 65535 they wrap to opts.rollover (0 or 1) so files of any size can be transferred */
+func (t *transfer) blockNumber(n uint64) uint16 {
+	if n <= 65535 {
+		return uint16(n)
+	}
+	period := uint64(65536 - int(t.opts.rollover))
+	return t.opts.rollover + uint16((n-65536)%period)
+}
+
+func (t *transfer) send(p packet) error {
+	return sendPacket(t.conn, t.peer, p)
+}
+
+/* answerTimeout returns how long to wait for the peer to answer the packet just sent */
+func (t *transfer) answerTimeout() time.Duration {
+	base := t.opts.timeout
+	if t.opts.retry.Adaptive {
+		min, max := t.opts.retry.adaptiveBounds(t.opts.timeout)
+		base = t.rtt.timeout(t.opts.timeout, min, max)
+	}
+	return t.opts.retry.timeout(base, t.backoff, true)
+}
+
+/* retry counts a timeout while waiting for an answer. It returns ErrTimeout once every retransmission has been used */
+func (t *transfer) retry() error {
+	t.retryCount += 1
+	t.backoff += 1
+	if t.retryCount > t.opts.retry.retries() {
+		return ErrTimeout
+	}
+	return nil
+}
+
+/* sampleRTT measures a round trip to the Ack of a packet that was sent once. A retransmission makes the */
+/* round trip ambiguous, so only then does the timeout return from the backed off value (Karn) */
+func (t *transfer) sampleRTT(rtt time.Duration) {
+	t.rtt.sample(rtt)
+	t.backoff = 0
+}
+
+/* receive waits upto timeout for the next packet from the peer. */
+/* Once the deadline of the transfer has passed, the peer is told so and ErrDeadline is returned */
+/* Packets from any other transfer ID are answered with an Unknown transfer ID error and do not affect the transfer. */
+/* A packet that cannot be decoded is answered with an Illegal TFTP operation error and ends the transfer */
+func (t *transfer) receive(timeout time.Duration) (packet, error) {
+	if !t.deadline.IsZero() {
+		remaining := time.Until(t.deadline)
+		if remaining <= 0 {
+			return nil, t.abort(ErrDeadline)
+		}
+		if timeout > remaining {
+			timeout = remaining
+		}
+	}
+	if len(t.ingressBuf) != 4+t.opts.blockSize+1 {
+		t.ingressBuf = make([]byte, 4+t.opts.blockSize+1)
+	}
+	t.conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		p, addr, err := receivePacket(t.conn, t.ingressBuf)
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			if !t.deadline.IsZero() && !time.Now().Before(t.deadline) {
+				return nil, t.abort(ErrDeadline)
+			}
+			return nil, ErrTimeout
+		} else if _, ok := err.(net.Error); ok {
+			return nil, err
+		}
+		if !t.fromPeer(addr) {
+			t.logf("Received a packet from unknown transfer ID %s", addr)
+			sendPacket(t.conn, addr, &ErrorPacket{Code: CodeUnknownTID, Message: CodeUnknownTID.String()})
+			continue
+		}
+		if err != nil {
+			t.send(illegalOperation(err))
+			return nil, err
+		}
+		return p, nil
+	}
+}
+
+/* receiveAnswer waits upto timeout for the packet that answers a request, a packet for which answer returns true. */
+/* Any other packet is handled by unexpected */
+func (t *transfer) receiveAnswer(timeout time.Duration, answer func(p packet) bool) (packet, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		p, err := t.receive(time.Until(deadline))
+		if err != nil {
+			return nil, err
+		}
+		if answer(p) {
+			return p, nil
+		}
+		if err := t.unexpected(p); err != nil {
+			return nil, err
+		}
+	}
+}
+
+/* request sends a request to the server and waits for the packet that answers it, */
+/* retransmitting the request every time the timeout expires */
+func (t *transfer) request(req packet, answer func(p packet) bool) (packet, error) {
+	for {
+		if err := t.send(req); err != nil {
+			return nil, err
+		}
+		p, err := t.receiveAnswer(t.answerTimeout(), answer)
+		if err == ErrTimeout {
+			if err := t.retry(); err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		t.retryCount = 0
+		return p, nil
+	}
+}
+
+/* fromPeer reports whether a packet from addr belongs to the transfer. */
+/* If the peer's port is not known yet, addr becomes the peer if it has the peer's IP address */
+func (t *transfer) fromPeer(addr *net.UDPAddr) bool {
+	if addr == nil || !addr.IP.Equal(t.peer.IP) {
+		return false
+	}
+	if !t.peerKnown {
+		t.peer = addr
+		t.peerKnown = true
+		return true
+	}
+	return addr.Port == t.peer.Port
+}
+
+/* abort reports err to the peer and returns it */
+func (t *transfer) abort(err error) error {
+	t.send(errorPacket(err))
+	return err
+}
+
+/* unexpected handles a packet from the peer that has no meaning at this point of the transfer, such as a late duplicate. */
+/* An ERROR packet ends the transfer and is returned as an *Error. Anything else is ignored and nil is returned */
+func (t *transfer) unexpected(p packet) error {
+	if errPacket, ok := p.(*ErrorPacket); ok {
+		return remoteError(errPacket)
+	}
+	t.logf("Ignoring unexpected %s packet", packetName(p))
+	return nil
+}
+
+/* sendData sends the contents of r as DATA blocks starting from block 1. */
+/* If start is not nil (an OACK) it is sent first and retransmitted until the peer acknowledges it with Ack 0 */
+func (t *transfer) sendData(r io.Reader, start packet) error {
+
+	/* window holds the blocks that have been read but not acknowledged, window[0] is block base+1 */
+	/* base counts blocks from the start of the transfer and does not wrap, see blockNumber */
+	/* Only the first sent blocks of the window have been transmitted since the last (re)transmission */
+	/* sentAt holds when each transmitted block of the window was first sent, or zero if it was sent again */
+
+	var window []*Data
+	var sentAt []time.Time
+	var base uint64 = 0
+	var sent int = 0
+	var lastRead bool = false
+	var deadline time.Time
+
+	if start != nil {
+		if err := t.send(start); err != nil {
+			return err
+		}
+		if err := t.waitForAck(start); err != nil {
+			return err
+		}
+	}
+	deadline = time.Now().Add(t.answerTimeout())
+	for {
+		for len(window) < t.opts.windowSize && !lastRead {
+			block, err := readBlock(r, t.opts.blockSize)
+			if err != nil {
+				return t.abort(err)
+			}
+			window = append(window, &Data{Block: t.blockNumber(base + uint64(len(window)) + 1), Data: block})
+
+			/* If data block is less than the block size, it is the last packet */
+
+			if len(block) < t.opts.blockSize {
+				lastRead = true
+			}
+		}
+		if len(window) == 0 {
+			return nil
+		}
+		for ; sent < len(window); sent++ {
+			if err := t.send(window[sent]); err != nil {
+				return err
+			}
+			if sent < len(sentAt) {
+				sentAt[sent] = time.Time{}
+			} else {
+				sentAt = append(sentAt, time.Now())
+			}
+			t.logf("Sent data block num: %d", window[sent].Block)
+		}
+
+		/* The whole window is retransmitted after read timeout for Ack from the peer, as often as the retry policy allows. */
+		/* Nothing else causes a retransmission. If a duplicate Ack did, every delayed packet would double */
+		/* the traffic for the rest of the transfer (Sorcerer's Apprentice syndrome, RFC 1123) */
+
+		ingress, err := t.receive(time.Until(deadline))
+		if err == ErrTimeout {
+			if err := t.retry(); err != nil {
+				return err
+			}
+			sent = 0
+			deadline = time.Now().Add(t.answerTimeout())
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		/* Only Ack packets from the peer matter on data channel while sending */
+		ack, ok := ingress.(*Ack)
+		if !ok {
+			if err := t.unexpected(ingress); err != nil {
+				return err
+			}
+			continue
+		}
+		t.logf("Received Ack for block: %d", ack.Block)
+
+		/* The Ack names the last block received in order. Blocks upto it leave the window and the */
+		/* blocks that make up for them are sent. An Ack short of the last block sent means the peer */
+		/* found a gap, so the rest of the window is sent again right away from the block after it */
+		/* An Ack for a block that was already acknowledged is a duplicate and is ignored without */
+		/* touching the timeout. An Ack for a block that was never sent is not allowed */
+
+		acked := -1
+		for i := 0; i <= sent; i++ {
+			if t.blockNumber(base+uint64(i)) == ack.Block {
+				acked = i
+				break
+			}
+		}
+		if acked == 0 || (acked < 0 && int16(ack.Block-t.blockNumber(base)) < 0) {
+			t.logf("Ignoring duplicate Ack for block: %d", ack.Block)
+			continue
+		}
+		if acked < 0 {
+			return t.abort(&Error{Code: CodeIllegalOperation, Message: fmt.Sprintf("unexpected Ack for block %d", ack.Block)})
+		}
+
+		/* The round trip is measured to the Ack of a block that was sent once, so that it cannot be */
+		/* mistaken for the answer to a retransmission */
+
+		if !sentAt[acked-1].IsZero() {
+			t.sampleRTT(time.Since(sentAt[acked-1]))
+		}
+		window = window[acked:]
+		sentAt = sentAt[acked:]
+		base += uint64(acked)
+		sent = 0
+		t.retryCount = 0
+		deadline = time.Now().Add(t.answerTimeout())
+	}
+}
+
+/* waitForAck waits for Ack 0 in answer to start and retransmits start every time the timeout expires */
+func (t *transfer) waitForAck(start packet) error {
+	sentAt := time.Now()
+	deadline := sentAt.Add(t.answerTimeout())
+	for {
+		ingress, err := t.receive(time.Until(deadline))
+		if err == ErrTimeout {
+			if err := t.retry(); err != nil {
+				return err
+			}
+			if err := t.send(start); err != nil {
+				return err
+			}
+			deadline = time.Now().Add(t.answerTimeout())
+			continue
+		} else if err != nil {
+			return err
+		}
+		ack, ok := ingress.(*Ack)
+		if !ok {
+			if err := t.unexpected(ingress); err != nil {
+				return err
+			}
+			continue
+		}
+		t.logf("Received Ack for block: %d", ack.Block)
+		if ack.Block != 0 {
+			return t.abort(&Error{Code: CodeIllegalOperation, Message: fmt.Sprintf("unexpected Ack for block %d", ack.Block)})
+		}
+		if t.retryCount == 0 {
+			t.sampleRTT(time.Since(sentAt))
+		}
+		t.retryCount = 0
+		return nil
+	}
+}
+
+/* waitForData waits for the first DATA block in answer to start (Ack 0 or an OACK) and retransmits start */
+/* every time the timeout expires, so that a lost start packet does not make the peer give up or ask again */
+func (t *transfer) waitForData(start packet) (*Data, error) {
+	deadline := time.Now().Add(t.answerTimeout())
+	for {
+		ingress, err := t.receive(time.Until(deadline))
+		if err == ErrTimeout {
+			if err := t.retry(); err != nil {
+				return nil, err
+			}
+			if err := t.send(start); err != nil {
+				return nil, err
+			}
+			deadline = time.Now().Add(t.answerTimeout())
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		data, ok := ingress.(*Data)
+		if !ok {
+			if err := t.unexpected(ingress); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return data, nil
+	}
+}
+
+/* receiveData receives DATA blocks into w until the last block, acknowledging every window. */
+/* It returns once the last block is written and acknowledged, dally answers the peer if that Ack gets lost */
+/* first is a DATA packet that has already been received, or nil */
+func (t *transfer) receiveData(w io.Writer, first *Data) error {
+
+	/* received is the last block received in order and acked the last block acknowledged to the peer. */
+	/* Both count blocks from the start of the transfer and do not wrap, see blockNumber */
+	/* unexpected is the last block that arrived out of order since then, so that a burst of them is answered only once */
+
+	var received uint64 = 0
+	var acked uint64 = 0
+	var unexpected uint16 = 0
+	var outOfOrder bool = false
+
+	for {
+		var ingress packet
+		if first != nil {
+			ingress, first = first, nil
+		} else {
+
+			/* The peer may need all of its retransmissions to get the next window through */
+
+			p, err := t.receive(t.opts.retry.patience(t.opts.timeout))
+			if err != nil {
+				return err
+			}
+			ingress = p
+		}
+
+		/* An OACK before any data means the Ack 0 that acknowledged it got lost */
+
+		if _, ok := ingress.(*OptionAck); ok && received == 0 {
+			if err := t.send(&Ack{Block: 0}); err != nil {
+				return err
+			}
+			continue
+		}
+		data, ok := ingress.(*Data)
+		if !ok {
+			if err := t.unexpected(ingress); err != nil {
+				return err
+			}
+			continue
+		}
+		t.logf("Received Data Block %d", data.Block)
+		if len(data.Data) > t.opts.blockSize {
+			return t.abort(&Error{Code: CodeIllegalOperation, Message: fmt.Sprintf("data block is larger than %d bytes", t.opts.blockSize)})
+		}
+
+		lastPacket := false
+		if data.Block == t.blockNumber(received+1) {
+			if _, err := w.Write(data.Data); err != nil {
+				return t.abort(err)
+			}
+			received += 1
+			outOfOrder = false
+			lastPacket = len(data.Data) < t.opts.blockSize
+
+			/* Ack the last block of every window, and the last block of the file right away */
+
+			if lastPacket == false && int(received-acked) < t.opts.windowSize {
+				continue
+			}
+		} else {
+
+			/* A block that was already received means an Ack got lost, and a block from beyond a gap means */
+			/* data got lost. Either way the peer is told where to resume, once for every burst it sends */
+			/* A new burst starts with a block at or before the previous unexpected one */
+
+			if outOfOrder == true && int16(data.Block-unexpected) > 0 {
+				unexpected = data.Block
+				continue
+			}
+			unexpected = data.Block
+			outOfOrder = true
+		}
+		acked = received
+		if err := t.send(&Ack{Block: t.blockNumber(acked)}); err != nil {
+			return err
+		}
+		t.logf("Sent Ack for block: %d", t.blockNumber(acked))
+		if lastPacket == true {
+			t.lastAck = t.blockNumber(acked)
+			return nil
+		}
+	}
+}
+
+/* dally waits one timeout after receiveData, in case the last Ack got lost and the peer sends the last block again. */
+/* The file is complete by then, so nothing that happens here fails the transfer and the deadline is not enforced */
+func (t *transfer) dally() {
+	timeout := t.opts.timeout
+	if !t.deadline.IsZero() {
+		if time.Until(t.deadline) < timeout {
+			timeout = time.Until(t.deadline)
+		}
+		t.deadline = time.Time{}
+	}
+	end := time.Now().Add(timeout)
+	for time.Until(end) > 0 {
+		p, err := t.receive(time.Until(end))
+		if err != nil {
+			return
+		}
+		if _, ok := p.(*Data); ok {
+			t.send(&Ack{Block: t.lastAck})
+		} else if err := t.unexpected(p); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* newTestPair returns a transfer on a loopback port and the socket of its peer */
+func newTestPair(t testing.TB, opts *transferOptions) (*transfer, *net.UDPConn) {
+	t.Helper()
+	local, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		local.Close()
+		peer.Close()
+	})
+	logf := func(format string, v ...interface{}) {}
+	return newTransfer(local, peer.LocalAddr().(*net.UDPAddr), opts, logf), peer
+}
+
+/* FuzzTransfer sends arbitrary datagrams from the peer to a transfer that is sending or receiving data */
+func FuzzTransfer(f *testing.F) {
+	f.Add(true, []byte("\x00\x04\x00\x01"), []byte("\x00\x04\x00\x05"))
+	f.Add(true, []byte("\x00\x04\x00\x00"), []byte("\x00\x04\xff\xff"))
+	f.Add(true, []byte("\x00\x05\x00\x01File not found\x00"), []byte{})
+	f.Add(true, []byte("\x00\x03\x00\x01data"), []byte("\x00\x06blksize\x008\x00"))
+	f.Add(false, []byte("\x00\x03\x00\x01short"), []byte("\x00\x03\x00\x01short"))
+	f.Add(false, []byte("\x00\x03\x00\x02data"), []byte("\x00\x03\x00\x00"))
+	f.Add(false, []byte("\x00\x06tsize\x001\x00"), []byte("\x00\x01f\x00octet\x00"))
+	f.Add(false, []byte{0}, bytes.Repeat([]byte{0xff}, 600))
+	f.Fuzz(func(t *testing.T, sending bool, first []byte, second []byte) {
+		opts := newTransferOptions(sending)
+		opts.blockSize = 16
+		opts.windowSize = 4
+		opts.timeout = 10 * time.Millisecond
+		opts.retry = RetryPolicy{Retries: 1, Deadline: 200 * time.Millisecond}
+		tr, peer := newTestPair(t, opts)
+		done := make(chan error, 1)
+		go func() {
+			if sending {
+				done <- tr.sendData(bytes.NewReader(make([]byte, 100)), nil)
+			} else {
+				done <- tr.receiveData(io.Discard, nil)
+			}
+		}()
+		local := tr.conn.LocalAddr().(*net.UDPAddr)
+		peer.WriteToUDP(first, local)
+		peer.WriteToUDP(second, local)
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("transfer did not end")
+		}
+	})
+}
+
+/* relay forwards datagrams between a client and a server, and lets a test delay, duplicate or drop them */
+type relay struct {
+	clientSide *net.UDPConn /* The client sends its requests here */
+	serverSide *net.UDPConn
+	server     *net.UDPAddr
+
+	/* forward returns the delay of every copy of p to send on, none to drop it */
+	forward func(p packet, toServer bool) []time.Duration
+
+	mu   sync.Mutex
+	data map[uint16]int /* DATA packets sent by the server, by block number */
+}
+
+func newRelay(t *testing.T, server *net.UDPAddr, forward func(p packet, toServer bool) []time.Duration) *relay {
+	t.Helper()
+	clientSide, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSide, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &relay{clientSide: clientSide, serverSide: serverSide, server: server, forward: forward, data: map[uint16]int{}}
+	t.Cleanup(func() {
+		clientSide.Close()
+		serverSide.Close()
+	})
+	var client *net.UDPAddr
+	var mu sync.Mutex
+	go r.run(clientSide, func(from *net.UDPAddr) (*net.UDPConn, *net.UDPAddr, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		client = from
+		return serverSide, r.server, true
+	})
+	go r.run(serverSide, func(from *net.UDPAddr) (*net.UDPConn, *net.UDPAddr, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		r.server = from /* The transfer ID of the server */
+		return clientSide, client, false
+	})
+	return r
+}
+
+func (r *relay) run(conn *net.UDPConn, route func(from *net.UDPAddr) (*net.UDPConn, *net.UDPAddr, bool)) {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		b := append([]byte(nil), buf[:n]...)
+		out, to, toServer := route(from)
+		p, err := parsePacket(b)
+		if err != nil {
+			continue
+		}
+		if data, ok := p.(*Data); ok {
+			r.mu.Lock()
+			r.data[data.Block]++
+			r.mu.Unlock()
+		}
+		for _, delay := range r.forward(p, toServer) {
+			if delay == 0 {
+				out.WriteToUDP(b, to) /* Sent right away so that packets stay in order */
+			} else {
+				time.AfterFunc(delay, func() { out.WriteToUDP(b, to) })
+			}
+		}
+	}
+}
+
+/* dataSent returns the number of DATA packets the server sent */
+func (r *relay) dataSent() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	total := 0
+	for _, count := range r.data {
+		total += count
+	}
+	return total
+}
+
+/* TestDelayedAcks checks that duplicated and late Acks do not make the sender send any block twice */
+/* (Sorcerer's Apprentice syndrome, RFC 1123) */
+func TestDelayedAcks(t *testing.T) {
+	backend := NewMemoryBackend()
+	want := bytes.Repeat([]byte("0123456789abcdef"), 32*40)
+	backend.Store("f", want)
+	server := newTestServer(t, &Server{Backend: backend, Timeout: time.Second})
+	r := newRelay(t, server, func(p packet, toServer bool) []time.Duration {
+		if _, ok := p.(*Ack); ok {
+			return []time.Duration{0, 0, 20 * time.Millisecond}
+		}
+		return []time.Duration{0}
+	})
+	local := filepath.Join(t.TempDir(), "f")
+	c := &Client{Addr: r.clientSide.LocalAddr().String(), Timeout: time.Second}
+	if err := c.Get("f", local); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(local); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	if sent := r.dataSent(); sent != 41 {
+		t.Errorf("server sent %d DATA packets for 41 blocks", sent)
+	}
+}
+
+/* TestWindowGap checks that a block lost from a window is sent again as soon as the peer reports the gap, */
+/* rather than after the timeout */
+func TestWindowGap(t *testing.T) {
+	backend := NewMemoryBackend()
+	want := bytes.Repeat([]byte("0123456789abcdef"), 32*40)
+	backend.Store("f", want)
+	server := newTestServer(t, &Server{Backend: backend, Timeout: 2 * time.Second})
+	var dropped sync.Map
+	r := newRelay(t, server, func(p packet, toServer bool) []time.Duration {
+		if data, ok := p.(*Data); ok && data.Block%10 == 2 {
+			if _, seen := dropped.LoadOrStore(data.Block, true); !seen {
+				return nil
+			}
+		}
+		return []time.Duration{0}
+	})
+	local := filepath.Join(t.TempDir(), "f")
+	c := &Client{Addr: r.clientSide.LocalAddr().String(), Timeout: 2 * time.Second, Options: map[string]string{"windowsize": "4"}}
+	start := time.Now()
+	if err := c.Get("f", local); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(local); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+
+	/* Every lost block sent again only when the timeout expires would add another 2 seconds */
+
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("transfer took %v", elapsed)
+	}
+
+	/* 41 blocks, and for each of the 4 gaps at most the rest of a window of 4 again */
+
+	if sent := r.dataSent(); sent < 45 || sent > 41+4*4 {
+		t.Errorf("server sent %d DATA packets for 41 blocks", sent)
+	}
+}
+
+/* TestBackoffUntilSample checks that the timeout stays backed off after a retransmission until a round trip */
+/* is measured from a block that was sent only once (Karn's algorithm) */
+func TestBackoffUntilSample(t *testing.T) {
+	opts := newTransferOptions(true)
+	opts.timeout = 50 * time.Millisecond
+	opts.retry = RetryPolicy{Backoff: 2}
+	tr, peer := newTestPair(t, opts)
+	done := make(chan error, 1)
+	go func() {
+		done <- tr.sendData(bytes.NewReader(make([]byte, 4*defaultBlockSize)), nil)
+	}()
+
+	/* The first copy of blocks 1, 2 and 4 is lost. Block 2 is retransmitted after a backed off timeout even though */
+	/* block 1 got through, and block 4 after the initial one again since block 3 was acknowledged the first time */
+
+	intervals := map[uint16]time.Duration{}
+	lastSent := map[uint16]time.Time{}
+	buf := make([]byte, 1024)
+	for {
+		peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, from, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := parsePacket(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := p.(*Data)
+		if sent, ok := lastSent[data.Block]; !ok && data.Block != 3 && len(data.Data) > 0 {
+			lastSent[data.Block] = time.Now()
+			continue
+		} else if ok {
+			intervals[data.Block] = time.Since(sent)
+		}
+		ack, _ := (&Ack{Block: data.Block}).MarshalBinary()
+		peer.WriteToUDP(ack, from)
+		if len(data.Data) < defaultBlockSize {
+			break
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if intervals[2] < 90*time.Millisecond {
+		t.Errorf("block 2 was sent again after %v, want the backed off 100ms", intervals[2])
+	}
+	if intervals[4] > 90*time.Millisecond {
+		t.Errorf("block 4 was sent again after %v, want the initial 50ms", intervals[4])
+	}
+}